@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/codeskyblue/proxylocal/pxlocal"
+	"github.com/gobuild/log"
+)
+
+// publicURL build visitor url from the address reported by server
+func publicURL(server *url.URL, opts pxlocal.ProxyOptions, remoteAddr string) string {
+	if opts.Proto == pxlocal.TCP {
+		return "tcp://" + remoteAddr
+	}
+	if server.Scheme == "wss" && !opts.PortTunnel {
+		return "https://" + remoteAddr
+	}
+	return "http://" + remoteAddr
+}
+
+// waitLocalReady poll local address until it accepts connections or child exits
+func waitLocalReady(localURL *url.URL, exited <-chan struct{}) bool {
+	network, addr := "tcp", localURL.Host
+	switch localURL.Scheme {
+	case "unix":
+		network, addr = "unix", localURL.Path
+	case "file":
+		return true
+	}
+	for {
+		conn, err := net.DialTimeout(network, addr, time.Second)
+		if err == nil {
+			conn.Close()
+			return true
+		}
+		select {
+		case <-exited:
+			return false
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// exitCode convert the result of cmd.Wait, a child killed by signal gets 128+signal like shells
+func exitCode(waitErr error) int {
+	exitErr, ok := waitErr.(*exec.ExitError)
+	if !ok {
+		if waitErr != nil {
+			return 1
+		}
+		return 0
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	if code := exitErr.ExitCode(); code > 0 {
+		return code
+	}
+	return 1
+}
+
+// runCommand run child process with the tunnel, return exit code of the child.
+// The tunnel is registered first, so the child gets the url assigned by server in PUBLIC_URL,
+// visitors get an error page until the local port accepts connections.
+func runCommand(client *pxlocal.Client, opts pxlocal.ProxyOptions, localURL *url.URL, args []string) int {
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigC)
+
+	// child is started after tunnel registered, so it can not wait for the child
+	opts.HealthCheck.WaitHealthy = false
+	var mu sync.Mutex
+	var current *pxlocal.ProxyConnector
+	var pubURL string
+	registered := make(chan struct{})
+	expired := make(chan struct{})
+	go func() {
+		keepProxy(client, opts, func(px *pxlocal.ProxyConnector) {
+			mu.Lock()
+			current = px
+			mu.Unlock()
+			go func() {
+				remoteAddr, err := px.WaitRemoteAddr(10 * time.Second)
+				if err != nil {
+					log.Warnf("tunnel not ready: %v", err)
+					return
+				}
+				actual := publicURL(client.URL(), opts, remoteAddr)
+				mu.Lock()
+				defer mu.Unlock()
+				switch pubURL {
+				case "":
+					pubURL = actual
+					close(registered)
+				case actual:
+				default:
+					log.Warnf("tunnel is at %s after reconnect, but PUBLIC_URL of the command is %s", actual, pubURL)
+				}
+			}()
+		})
+		close(expired)
+	}()
+	closeTunnel := func() {
+		mu.Lock()
+		if current != nil {
+			current.Close()
+		}
+		mu.Unlock()
+	}
+
+	select {
+	case <-registered:
+	case <-expired:
+		return 1
+	case sig := <-sigC:
+		closeTunnel()
+		return 128 + int(sig.(syscall.Signal))
+	}
+	mu.Lock()
+	env := []string{"PUBLIC_URL=" + pubURL, "PROXYLOCAL_URL=" + pubURL}
+	readyMsg := "Local service is ready, publicly available via: " + pubURL
+	mu.Unlock()
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		log.Errorf("start command: %v", err)
+		closeTunnel()
+		return 127
+	}
+	go func() {
+		for sig := range sigC {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	exited := make(chan struct{})
+	var waitErr error
+	go func() {
+		waitErr = cmd.Wait()
+		close(exited)
+	}()
+	go func() {
+		if waitLocalReady(localURL, exited) {
+			fmt.Println(readyMsg)
+		}
+	}()
+
+	select {
+	case <-exited:
+	case <-expired:
+		cmd.Process.Signal(syscall.SIGTERM)
+		<-exited
+	}
+	closeTunnel()
+	return exitCode(waitErr)
+}
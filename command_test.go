@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/codeskyblue/proxylocal/pxlocal"
+)
+
+func TestRunCommandPublicURL(t *testing.T) {
+	localURL, _ := url.Parse("http://127.0.0.1:1")
+	for _, c := range []struct {
+		name        string
+		pathTunnels bool
+		opts        pxlocal.ProxyOptions
+		expect      string
+	}{
+		// server domain is not the host client dialed
+		{"random subdomain", false, pxlocal.ProxyOptions{Proto: pxlocal.HTTP}, `^http://[a-z0-9-]+\.pxl\.test$`},
+		{"path tunnel", true, pxlocal.ProxyOptions{Proto: pxlocal.HTTP, Subdomain: "app"}, `^http://pxl\.test:\d+/t/app/$`},
+		{"tcp", false, pxlocal.ProxyOptions{Proto: pxlocal.TCP}, `^tcp://pxl\.test:\d+$`},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ps := pxlocal.NewProxyServer("pxl.test")
+			ps.PathTunnels = c.pathTunnels
+			server := httptest.NewServer(ps)
+			t.Cleanup(server.Close)
+
+			out := filepath.Join(t.TempDir(), "url")
+			c.opts.LocalAddr = localURL.Host
+			code := runCommand(pxlocal.NewClient(server.URL), c.opts, localURL, []string{"sh", "-c", `printf %s "$PUBLIC_URL" > ` + out})
+			if code != 0 {
+				t.Fatalf("expect exit code 0, but got %d", code)
+			}
+			data, _ := os.ReadFile(out)
+			if !regexp.MustCompile(c.expect).Match(data) {
+				t.Errorf("expect PUBLIC_URL like %s, but got %q", c.expect, data)
+			}
+		})
+	}
+}
+
+func TestRunCommandExitCode(t *testing.T) {
+	server := httptest.NewServer(pxlocal.NewProxyServer("pxl.test"))
+	t.Cleanup(server.Close)
+	localURL, _ := url.Parse("http://127.0.0.1:1")
+	opts := pxlocal.ProxyOptions{Proto: pxlocal.HTTP, LocalAddr: localURL.Host}
+	if code := runCommand(pxlocal.NewClient(server.URL), opts, localURL, []string{"sh", "-c", "exit 3"}); code != 3 {
+		t.Errorf("expect exit code of command, but got %d", code)
+	}
+	if code := runCommand(pxlocal.NewClient(server.URL), opts, localURL, []string{"sh", "-c", "kill -TERM $$"}); code != 128+15 {
+		t.Errorf("expect 128+signal, but got %d", code)
+	}
+}
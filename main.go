@@ -5,9 +5,13 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/alecthomas/kingpin/v2"
@@ -17,16 +21,62 @@ import (
 
 type GlobalConfig struct {
 	Server struct {
-		Enable bool
-		Addr   string
-		Domain string
+		Enable        bool
+		Addr          string
+		Domains       []string
+		DefaultDomain string
+		TLSListen     string
+		ErrorPages    string
+		PathTunnels   bool
+		TrustedProxy  []string
+		DNSListen     string
+		DNSIPs        []net.IP
+		DNSStrict     bool
+		DNSTXT        map[string]string
+		UsersFile     string
+		AuthKeysFile  string
+		ClientCA      string
+		Reserved      []string
+		SubdomainMin  int
+		SubdomainMax  int
 	}
 
-	Proto     string
-	Data      string
-	ProxyPort int
-	SubDomain string
-	Debug     bool
+	Proto         string
+	Data          string
+	ProxyPort     int
+	TunnelDomain  string
+	SubDomain     string
+	Debug         bool
+	TTL           time.Duration
+	ShareTTL      time.Duration
+	ShareOnce     bool
+	ProxyProtocol string
+	HostHeader    string
+
+	Rewrite          bool
+	RewriteBody      bool
+	RewriteBodyLimit int64
+	MaintenancePage  string
+	UpstreamTLS      pxlocal.UpstreamTLS
+	ServerTLS        pxlocal.ClientTLS
+	Static           pxlocal.StaticOptions
+	Command          []string
+	HealthCheck      pxlocal.HealthCheck
+	GroupKey         string
+	LoadBalance      string
+	LocalBalance     string
+	PathPrefix       string
+	StripPrefix      bool
+	PortTunnel       bool
+	Wildcard         bool
+	Hostnames        []string
+	Token            string
+	UserToken        string
+	Private          string
+	Secret           string
+	Visit            string
+	Identity         bool
+	IdentityFile     string
 }
 
 var cfg GlobalConfig
@@ -35,16 +85,75 @@ var localAddr string
 func init() {
 	kingpin.Flag("debug", "Enable debug mode.").BoolVar(&cfg.Debug)
 
-	kingpin.Flag("proto", "Default protocol, http or tcp").Default("http").Short('p').EnumVar(&cfg.Proto, "http", "tcp") // .StringVar(&cfg.Proto)
+	kingpin.Flag("proto", "Default protocol, http, http2, static or tcp, http2 is used for gRPC, static serve a local directory").Default("http").Short('p').EnumVar(&cfg.Proto, "http", "http2", "static", "tcp") // .StringVar(&cfg.Proto)
 	kingpin.Flag("subdomain", "Proxy subdomain, used for http").StringVar(&cfg.SubDomain)
-	kingpin.Flag("remote-port", "Proxy server listen port, only used in tcp").IntVar(&cfg.ProxyPort)
+	kingpin.Flag("path", "Path prefix on the subdomain, tunnels of different clients can share one host, used for http").StringVar(&cfg.PathPrefix)
+	kingpin.Flag("strip-path", "Remove path prefix before forwarding to local service").BoolVar(&cfg.StripPrefix)
+	kingpin.Flag("proxy-protocol", "Send PROXY protocol header to local service, only used in tcp").EnumVar(&cfg.ProxyProtocol, "v1", "v2")
+	kingpin.Flag("host-header", "Host header send to local service: preserve, rewrite or a custom host, used for http").Default(pxlocal.HOST_HEADER_REWRITE).StringVar(&cfg.HostHeader)
+	kingpin.Flag("rewrite", "Rewrite local address in Location and cookie domain to public url, used for http").BoolVar(&cfg.Rewrite)
+	kingpin.Flag("rewrite-body", "Also rewrite local address in html and json body, used for http").BoolVar(&cfg.RewriteBody)
+	kingpin.Flag("rewrite-body-limit", "Skip body rewrite when body is larger then this bytes").Default("2097152").Int64Var(&cfg.RewriteBodyLimit)
+	kingpin.Flag("maintenance-page", "Html file shown to visitors when local service is down, used for http").ExistingFileVar(&cfg.MaintenancePage)
+	kingpin.Flag("local-ca", "CA bundle to verify https local service").ExistingFileVar(&cfg.UpstreamTLS.CAFile)
+	kingpin.Flag("local-cert", "Client certificate for https local service").ExistingFileVar(&cfg.UpstreamTLS.CertFile)
+	kingpin.Flag("local-key", "Client certificate key for https local service").ExistingFileVar(&cfg.UpstreamTLS.KeyFile)
+	kingpin.Flag("local-insecure", "Skip certificate verify of https local service").BoolVar(&cfg.UpstreamTLS.InsecureSkipVerify)
+	kingpin.Flag("local-sni", "Server name used in tls handshake with local service").StringVar(&cfg.UpstreamTLS.ServerName)
+	kingpin.Flag("listing", "Show directory listing, used for static").Default("true").BoolVar(&cfg.Static.ListDirectory)
+	kingpin.Flag("spa", "Serve index.html for unknown paths, used for static").BoolVar(&cfg.Static.SPA)
+	kingpin.Flag("show-hidden", "Serve dotfiles like .git and .env, used for static").BoolVar(&cfg.Static.ShowHidden)
+	kingpin.Flag("allow-upload", "Allow upload files with PUT, used for static").BoolVar(&cfg.Static.AllowUpload)
+	kingpin.Flag("max-upload", "Max bytes of an uploaded file, used for static").Default("104857600").Int64Var(&cfg.Static.MaxUpload)
+	kingpin.Flag("health-check", "Probe local service with tcp or http, visitors get service unavailable when it fails").EnumVar(&cfg.HealthCheck.Type, "tcp", "http")
+	kingpin.Flag("health-path", "Request path of http health check").Default("/").StringVar(&cfg.HealthCheck.Path)
+	kingpin.Flag("health-interval", "Interval of health check").Default("5s").DurationVar(&cfg.HealthCheck.Interval)
+	kingpin.Flag("wait-healthy", "Register tunnel only after health check passed").BoolVar(&cfg.HealthCheck.WaitHealthy)
+	kingpin.Flag("group", "Join clients with the same group key into one subdomain or tcp port").OverrideDefaultFromEnvar("PXL_GROUP_KEY").StringVar(&cfg.GroupKey)
+	kingpin.Flag("lb", "Load balance of group: round-robin or least-conn").Default(pxlocal.LB_ROUND_ROBIN).EnumVar(&cfg.LoadBalance, pxlocal.LB_ROUND_ROBIN, pxlocal.LB_LEAST_CONN)
+	kingpin.Flag("local-lb", "Load balance of several local addresses: round-robin, random or least-conn").Default(pxlocal.LB_ROUND_ROBIN).EnumVar(&cfg.LocalBalance, pxlocal.LB_ROUND_ROBIN, pxlocal.LB_RANDOM, pxlocal.LB_LEAST_CONN)
+	kingpin.Flag("wildcard", "Also claim *.<subdomain>.<domain>, used for http").BoolVar(&cfg.Wildcard)
+	kingpin.Flag("hostname", "Custom hostname CNAME'd to the server, needs TXT record _proxylocal-challenge.<hostname> naming the identity key, can be repeated, used for http").StringsVar(&cfg.Hostnames)
+	kingpin.Flag("port-tunnel", "Serve http tunnel on a public port instead of subdomain, used when there is no wildcard dns").BoolVar(&cfg.PortTunnel)
+	kingpin.Flag("remote-port", "Proxy server listen port, used in tcp and --port-tunnel").IntVar(&cfg.ProxyPort)
 	kingpin.Flag("data", "Data send to server, can be anything").StringVar(&cfg.Data)
+	kingpin.Flag("ttl", "Tunnel max lifetime, ex: 1h, server close it after that").DurationVar(&cfg.TTL)
+	kingpin.Flag("share-ttl", "Require a share link to visit, the link is valid for this duration, used for http").DurationVar(&cfg.ShareTTL)
+	kingpin.Flag("share-once", "Require a share link to visit, the link can only be opened once, used for http").BoolVar(&cfg.ShareOnce)
 	kingpin.Flag("server", "Specify server address").Short('s').OverrideDefaultFromEnvar("PXL_SERVER_ADDR").Default("https://your-proxylocal-domain.com").StringVar(&cfg.Server.Addr)
 
 	kingpin.Flag("listen", "Run in server mode").Short('l').BoolVar(&cfg.Server.Enable)
-	kingpin.Flag("domain", "Proxy server mode domain name, optional").StringVar(&cfg.Server.Domain)
+	kingpin.Flag("domain", "Proxy server mode base domain, can be repeated, ex: example.com,protocols=http+tcp,token=xx,cert=file,key=file").StringsVar(&cfg.Server.Domains)
+	kingpin.Flag("tunnel-domain", "Base domain of the tunnel, one of --domain of the server, default is picked by server").StringVar(&cfg.TunnelDomain)
+	kingpin.Flag("default-domain", "Proxy server mode domain used when client does not pick one, default is the first --domain").StringVar(&cfg.Server.DefaultDomain)
+	kingpin.Flag("tls-listen", "Proxy server mode also serve https on this address, ex: :443, certificates come from --domain").StringVar(&cfg.Server.TLSListen)
+	kingpin.Flag("dns-listen", "Proxy server mode run authoritative dns for the domains on udp and tcp, ex: :53").StringVar(&cfg.Server.DNSListen)
+	kingpin.Flag("dns-ip", "Public ip answered by dns, can be repeated, default is the ip of outbound interface").IPListVar(&cfg.Server.DNSIPs)
+	kingpin.Flag("dns-strict", "Answer NXDOMAIN for subdomains without tunnel").BoolVar(&cfg.Server.DNSStrict)
+	kingpin.Flag("dns-txt", "TXT record, ex: _acme-challenge.example.com=xxx").StringMapVar(&cfg.Server.DNSTXT)
+	kingpin.Flag("users", "Proxy server mode users file, every line is: name token [prefix,...], users only claim subdomains with their prefixes").ExistingFileVar(&cfg.Server.UsersFile)
+	kingpin.Flag("authorized-keys", "Proxy server mode only clients with identity keys in this file are accepted, options restrict protocols, subdomains, ports and max-tunnels, reloaded on SIGHUP").ExistingFileVar(&cfg.Server.AuthKeysFile)
+	kingpin.Flag("client-ca", "Proxy server mode require client certificates signed by this CA on --tls-listen, common name of certificate is the user").ExistingFileVar(&cfg.Server.ClientCA)
+	kingpin.Flag("tls-cert", "Client certificate for proxy server with mutual tls").ExistingFileVar(&cfg.ServerTLS.CertFile)
+	kingpin.Flag("tls-key", "Client certificate key for proxy server with mutual tls").ExistingFileVar(&cfg.ServerTLS.KeyFile)
+	kingpin.Flag("tls-ca", "CA bundle to verify proxy server").ExistingFileVar(&cfg.ServerTLS.CAFile)
+	kingpin.Flag("tls-pin", "Sha256 of proxy server public key in base64, ex: sha256//xxx, can be repeated").StringsVar(&cfg.ServerTLS.Pins)
+	kingpin.Flag("reserved", "Proxy server mode subdomains can not be claimed, can be repeated").Default(pxlocal.DefaultReservedNames...).StringsVar(&cfg.Server.Reserved)
+	kingpin.Flag("subdomain-min-length", "Proxy server mode min length of subdomain chosen by client").Default("1").IntVar(&cfg.Server.SubdomainMin)
+	kingpin.Flag("subdomain-max-length", "Proxy server mode max length of subdomain").Default("63").IntVar(&cfg.Server.SubdomainMax)
+	kingpin.Flag("identity", "Send identity key, server derive a stable subdomain from it when --subdomain is not set, implied by --identity-file and --hostname").BoolVar(&cfg.Identity)
+	kingpin.Flag("identity-file", "Ed25519 identity key, created when not exists, default ~/.proxylocal/id_ed25519").StringVar(&cfg.IdentityFile)
+	kingpin.Flag("token", "Token required by access policy of the domain").OverrideDefaultFromEnvar("PXL_TOKEN").StringVar(&cfg.Token)
+	kingpin.Flag("user-token", "Token of your user in --users file of server").OverrideDefaultFromEnvar("PXL_USER_TOKEN").StringVar(&cfg.UserToken)
+	kingpin.Flag("private", "Register a tcp tunnel only reachable by --visit clients, end to end encrypted with --secret").StringVar(&cfg.Private)
+	kingpin.Flag("visit", "Expose private tunnel of this name on local address, ex: --visit db --secret xx 127.0.0.1:5432").StringVar(&cfg.Visit)
+	kingpin.Flag("secret", "Shared secret of private tunnel, at least 16 characters, never sent to server, generated when --private is used without it").OverrideDefaultFromEnvar("PXL_SECRET").StringVar(&cfg.Secret)
+	kingpin.Flag("error-pages", "Proxy server mode directory of error page templates, ex: offline.html, notfound.json").ExistingDirVar(&cfg.Server.ErrorPages)
+	kingpin.Flag("trusted-proxy", "Proxy server mode ip or cidr of a proxy in front, its Forwarded and X-Forwarded-For headers are appended to instead of replaced, can be repeated").StringsVar(&cfg.Server.TrustedProxy)
+	kingpin.Flag("path-tunnels", "Proxy server mode expose http tunnels at http://domain/t/<name>/, used when there is no wildcard dns").BoolVar(&cfg.Server.PathTunnels)
 
-	kingpin.Arg("local", "Local address").Required().StringVar(&localAddr)
+	kingpin.Arg("local", "Local address, several comma separated addresses are load balanced").Required().StringVar(&localAddr)
+	kingpin.Arg("command", "Command to run after --, tunnel is closed when it exits").StringsVar(&cfg.Command)
 }
 
 func parseURL(addr string, defaultProto string) (u *url.URL, err error) {
@@ -62,6 +171,29 @@ func parseURL(addr string, defaultProto string) (u *url.URL, err error) {
 	return url.Parse(addr)
 }
 
+// reloadOnHangup reload authorized keys on SIGHUP, old keys are kept when file is broken
+func reloadOnHangup(ak *pxlocal.AuthorizedKeys) {
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGHUP)
+	for range sigC {
+		if err := ak.Reload(); err != nil {
+			log.Warnf("reload authorized keys: %v", err)
+		} else {
+			log.Info("authorized keys reloaded")
+		}
+	}
+}
+
+// outboundIP is the local ip used to reach internet, no packet is sent
+func outboundIP() (net.IP, error) {
+	conn, err := net.Dial("udp", "8.8.8.8:53")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
 func extractHostname(addr string) string {
 	if strings.Contains(addr, "://") {
 		addr = strings.SplitN(addr, "://", 2)[1]
@@ -85,7 +217,37 @@ func main() {
 		log.SetOutputLevel(log.Ldebug)
 	}
 
-	pURL, err := pxlocal.ParseURL(localAddr, pxlocal.URLOpts{DefaultScheme: cfg.Proto})
+	if cfg.Visit != "" {
+		client := pxlocal.NewClient(cfg.Server.Addr)
+		if err := client.SetTLS(cfg.ServerTLS); err != nil {
+			log.Fatal(err)
+		}
+		if _, err := strconv.Atoi(localAddr); err == nil {
+			localAddr = "127.0.0.1:" + localAddr
+		}
+		lis, err := net.Listen("tcp", localAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("proxylocal: private tunnel %s is available on %v\n", cfg.Visit, lis.Addr())
+		log.Fatal(client.Visit(cfg.Visit, cfg.Secret, lis))
+	}
+	if cfg.Private != "" {
+		cfg.Proto = string(pxlocal.TCP) // private tunnels are tcp only
+		if cfg.Secret == "" {
+			cfg.Secret = pxlocal.GenerateSecret()
+			fmt.Printf("proxylocal: secret of private tunnel %s is %s, visitors need it\n", cfg.Private, cfg.Secret)
+		}
+	}
+	if cfg.Proto == string(pxlocal.STATIC) && !strings.Contains(localAddr, "://") {
+		abs, err := filepath.Abs(localAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		localAddr = "file://" + filepath.ToSlash(abs)
+	}
+	// several local addresses are load balanced by client, the first one is shown
+	pURL, err := pxlocal.ParseURL(strings.Split(localAddr, ",")[0], pxlocal.URLOpts{DefaultScheme: cfg.Proto})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -96,26 +258,178 @@ func main() {
 			port = "80"
 		}
 		addr := net.JoinHostPort("0.0.0.0", port)
-		if cfg.Server.Domain == "" {
-			cfg.Server.Domain = extractHostname(cfg.Server.Addr)
+		if len(cfg.Server.Domains) == 0 {
+			cfg.Server.Domains = []string{extractHostname(cfg.Server.Addr)}
+		}
+		var domains []pxlocal.DomainConfig
+		for _, spec := range cfg.Server.Domains {
+			dc, err := pxlocal.ParseDomainConfig(spec)
+			if err != nil {
+				log.Fatal(err)
+			}
+			domains = append(domains, dc)
+		}
+		if cfg.Server.DefaultDomain == "" {
+			cfg.Server.DefaultDomain = domains[0].Name
+		}
+		fmt.Printf("proxylocal: server listen on %v, domain is %v\n", addr, cfg.Server.DefaultDomain)
+		ps := pxlocal.NewProxyServer(domains[0].Name)
+		for _, dc := range domains {
+			if err := ps.AddDomain(dc); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := ps.SetDefaultDomain(cfg.Server.DefaultDomain); err != nil {
+			log.Fatal(err)
+		}
+		ps.PathTunnels = cfg.Server.PathTunnels
+		if ps.TrustedProxies, err = pxlocal.ParseTrustedProxies(cfg.Server.TrustedProxy); err != nil {
+			log.Fatal(err)
+		}
+		if err := ps.Policy.SetReserved(cfg.Server.Reserved); err != nil {
+			log.Fatal(err)
+		}
+		ps.Policy.MinLength, ps.Policy.MaxLength = cfg.Server.SubdomainMin, cfg.Server.SubdomainMax
+		if cfg.Server.UsersFile != "" {
+			if ps.Policy.Users, err = pxlocal.LoadUsers(cfg.Server.UsersFile); err != nil {
+				log.Fatal(err)
+			}
 		}
-		fmt.Printf("proxylocal: server listen on %v, domain is %v\n", addr, cfg.Server.Domain)
-		ps := pxlocal.NewProxyServer(cfg.Server.Domain)
-		log.Fatal(http.ListenAndServe(addr, ps))
+		if cfg.Server.AuthKeysFile != "" {
+			if ps.AuthorizedKeys, err = pxlocal.LoadAuthorizedKeys(cfg.Server.AuthKeysFile); err != nil {
+				log.Fatal(err)
+			}
+			go reloadOnHangup(ps.AuthorizedKeys)
+		}
+		if cfg.Server.ClientCA != "" {
+			if ps.ClientCAs, err = pxlocal.LoadCertPool(cfg.Server.ClientCA); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if cfg.Server.ErrorPages != "" {
+			if ps.ErrorPages, err = pxlocal.LoadErrorPages(cfg.Server.ErrorPages); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if cfg.Server.DNSListen != "" {
+			if len(cfg.Server.DNSIPs) == 0 {
+				ip, err := outboundIP()
+				if err != nil {
+					log.Fatalf("detect public ip: %v, use --dns-ip", err)
+				}
+				if ip.IsPrivate() || ip.IsLoopback() {
+					log.Warnf("dns answers private ip %v, the server is behind nat? use --dns-ip", ip)
+				}
+				cfg.Server.DNSIPs = []net.IP{ip}
+			}
+			dns := pxlocal.NewDNSServer(ps, cfg.Server.DNSIPs)
+			dns.Strict = cfg.Server.DNSStrict
+			for name, value := range cfg.Server.DNSTXT {
+				dns.SetTXT(name, value)
+			}
+			fmt.Printf("proxylocal: dns listen on %v, answer %v\n", cfg.Server.DNSListen, cfg.Server.DNSIPs)
+			go func() {
+				log.Fatal(dns.ListenAndServe(cfg.Server.DNSListen))
+			}()
+		}
+		if cfg.Server.TLSListen != "" {
+			tlsSrv := &http.Server{
+				Addr:      cfg.Server.TLSListen,
+				Handler:   ps,
+				TLSConfig: ps.TLSConfig(),
+			}
+			go func() {
+				log.Fatal(tlsSrv.ListenAndServeTLS("", ""))
+			}()
+		}
+		srv := &http.Server{
+			Addr:      addr,
+			Handler:   ps,
+			Protocols: pxlocal.ServerProtocols(),
+		}
+		log.Fatal(srv.ListenAndServe())
+	}
+	if len(cfg.Server.Domains) > 0 {
+		log.Fatal("--domain is for proxy server mode, use --tunnel-domain to pick a base domain")
 	}
 
+	var maintenancePage []byte
+	if cfg.MaintenancePage != "" {
+		if maintenancePage, err = os.ReadFile(cfg.MaintenancePage); err != nil {
+			log.Fatal(err)
+		}
+	}
 	client := pxlocal.NewClient(cfg.Server.Addr)
+	if err := client.SetTLS(cfg.ServerTLS); err != nil {
+		log.Fatal(err)
+	}
 	fmt.Println("proxy server:", client.URL())
 	fmt.Println("local server:", pURL)
+	opts := pxlocal.ProxyOptions{
+		Proto:         pxlocal.ProxyProtocol(cfg.Proto),
+		Subdomain:     cfg.SubDomain,
+		LocalAddr:     localAddr,
+		ListenPort:    cfg.ProxyPort,
+		TTL:           cfg.TTL,
+		ShareTTL:      cfg.ShareTTL,
+		ShareOnce:     cfg.ShareOnce,
+		ProxyProtocol: cfg.ProxyProtocol,
+		HostHeader:    cfg.HostHeader,
+
+		RewriteResponse:  cfg.Rewrite,
+		RewriteBody:      cfg.RewriteBody,
+		RewriteBodyLimit: cfg.RewriteBodyLimit,
+		MaintenancePage:  string(maintenancePage),
+		UpstreamTLS:      cfg.UpstreamTLS,
+		Static:           cfg.Static,
+		HealthCheck:      cfg.HealthCheck,
+		GroupKey:         cfg.GroupKey,
+		LoadBalance:      cfg.LoadBalance,
+		LocalBalance:     cfg.LocalBalance,
+		PathPrefix:       cfg.PathPrefix,
+		StripPrefix:      cfg.StripPrefix,
+		PortTunnel:       cfg.PortTunnel,
+		Wildcard:         cfg.Wildcard,
+		Hostnames:        cfg.Hostnames,
+		Token:            cfg.Token,
+		UserToken:        cfg.UserToken,
+		Domain:           cfg.TunnelDomain,
+		Private:          cfg.Private,
+		Secret:           cfg.Secret,
+	}
+	// opt-in, old servers do not answer the key challenge
+	if cfg.Identity || cfg.IdentityFile != "" || len(cfg.Hostnames) > 0 {
+		if cfg.IdentityFile == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				log.Fatal(err)
+			}
+			cfg.IdentityFile = filepath.Join(home, ".proxylocal", "id_ed25519")
+		}
+		if opts.IdentityKey, err = pxlocal.LoadOrCreateIdentityKey(cfg.IdentityFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(cfg.Command) > 0 {
+		os.Exit(runCommand(client, opts, pURL, cfg.Command))
+	}
+	keepProxy(client, opts, nil)
+}
+
+// keepProxy run the tunnel and reconnect when it breaks, return when tunnel expired
+func keepProxy(client *pxlocal.Client, opts pxlocal.ProxyOptions, onConnect func(*pxlocal.ProxyConnector)) {
 	for {
-		px, err := client.RunProxy(pxlocal.ProxyOptions{
-			Proto:      pxlocal.ProxyProtocol(cfg.Proto),
-			Subdomain:  cfg.SubDomain,
-			LocalAddr:  localAddr,
-			ListenPort: cfg.ProxyPort,
-		})
+		px, err := client.RunProxy(opts)
 		if err == nil {
+			if onConnect != nil {
+				onConnect(px)
+			}
 			err = px.Wait()
+			if err == pxlocal.ErrTunnelExpired {
+				return
+			}
+		} else if err == pxlocal.ErrIdentityUnsupported {
+			log.Fatalf("%v, run without --identity and --hostname", err)
 		} else {
 			log.Warnf("RunProxy error: %v", err)
 			fmt.Println("Reconnect after 5 seconds ...")
@@ -0,0 +1,332 @@
+package pxlocal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrKeyNotAuthorized = errors.New("identity key is not authorized")
+	ErrKeyRestricted    = errors.New("not allowed for this key")
+)
+
+// authorizedKey is a line of authorized keys file
+type authorizedKey struct {
+	comment    string
+	protocols  []string
+	identity   *Identity // subdomains restriction, nil means any
+	ports      [][2]int  // port ranges, empty means any
+	maxTunnels int       // 0 means no limit
+}
+
+func (k *authorizedKey) allowProtocol(protocol string) error {
+	if len(k.protocols) == 0 {
+		return nil
+	}
+	for _, p := range k.protocols {
+		if p == protocol || (p == "http" && (protocol == "http2" || protocol == "https")) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: protocol %s", ErrKeyRestricted, protocol)
+}
+
+func (k *authorizedKey) allowPort(port int) bool {
+	if len(k.ports) == 0 {
+		return true
+	}
+	for _, r := range k.ports {
+		if port >= r[0] && port <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthorizedKeys only clients with these keys can create tunnels,
+// file format is like authorized_keys of openssh:
+//
+//	[options] ssh-ed25519 AAAAC3Nza... comment
+//	[options] ed25519 <base64url of raw key> comment
+//
+// options: protocols="http,tcp",subdomains="alice-*,blog",ports="40000-40010",max-tunnels=3
+type AuthorizedKeys struct {
+	filename string
+	sync.Mutex
+	keys   map[string]*authorizedKey // key is the raw public key
+	active map[string]int
+}
+
+func LoadAuthorizedKeys(filename string) (*AuthorizedKeys, error) {
+	ak := &AuthorizedKeys{filename: filename, active: make(map[string]int)}
+	return ak, ak.Reload()
+}
+
+// Reload read the file again, the old keys are kept when it fails
+func (ak *AuthorizedKeys) Reload() error {
+	data, err := os.ReadFile(ak.filename)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]*authorizedKey)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pub, key, err := parseAuthorizedKey(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", ak.filename, lineno, err)
+		}
+		keys[string(pub)] = key
+	}
+	ak.Lock()
+	ak.keys = keys
+	ak.Unlock()
+	return nil
+}
+
+func (ak *AuthorizedKeys) lookup(pub ed25519.PublicKey) (*authorizedKey, error) {
+	ak.Lock()
+	defer ak.Unlock()
+	key := ak.keys[string(pub)]
+	if key == nil {
+		return nil, ErrKeyNotAuthorized
+	}
+	return key, nil
+}
+
+// acquire count a tunnel of the key, call release when tunnel closed
+func (ak *AuthorizedKeys) acquire(pub ed25519.PublicKey, key *authorizedKey) (release func(), err error) {
+	ak.Lock()
+	defer ak.Unlock()
+	id := string(pub)
+	if key.maxTunnels > 0 && ak.active[id] >= key.maxTunnels {
+		return nil, fmt.Errorf("%w: max %d tunnels", ErrKeyRestricted, key.maxTunnels)
+	}
+	ak.active[id]++
+	return func() {
+		ak.Lock()
+		defer ak.Unlock()
+		if ak.active[id]--; ak.active[id] <= 0 {
+			delete(ak.active, id)
+		}
+	}, nil
+}
+
+func parseAuthorizedKey(line string) (ed25519.PublicKey, *authorizedKey, error) {
+	options, rest := "", line
+	if !strings.HasPrefix(line, "ssh-ed25519 ") && !strings.HasPrefix(line, "ed25519 ") {
+		options, rest = splitOptions(line)
+	}
+	fields := strings.Fields(rest)
+	if len(fields) < 2 {
+		return nil, nil, errors.New("expect key type and key")
+	}
+	var pub ed25519.PublicKey
+	var err error
+	switch fields[0] {
+	case "ssh-ed25519":
+		pub, err = parseSSHPublicKey(fields[1])
+	case "ed25519":
+		pub, err = decodePublicKey(fields[1])
+	default:
+		err = fmt.Errorf("unsupported key type %s", fields[0])
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	key := &authorizedKey{comment: strings.Join(fields[2:], " ")}
+	for _, opt := range splitQuoted(options) {
+		name, value, _ := strings.Cut(opt, "=")
+		value = strings.Trim(value, `"`)
+		switch name {
+		case "protocols":
+			key.protocols = strings.Split(value, ",")
+		case "subdomains":
+			key.identity = &Identity{Name: key.comment}
+			for _, s := range strings.Split(strings.ToLower(value), ",") {
+				if prefix, ok := strings.CutSuffix(s, "*"); ok {
+					if err := checkPrefix(prefix); err != nil {
+						return nil, nil, err
+					}
+					key.identity.Prefixes = append(key.identity.Prefixes, prefix)
+				} else {
+					if err := checkLabel(s); err != nil {
+						return nil, nil, err
+					}
+					key.identity.Names = append(key.identity.Names, s)
+				}
+			}
+		case "ports":
+			for _, s := range strings.Split(value, ",") {
+				lo, hi, found := strings.Cut(s, "-")
+				if !found {
+					hi = lo
+				}
+				min, err1 := strconv.Atoi(lo)
+				max, err2 := strconv.Atoi(hi)
+				if err1 != nil || err2 != nil || min > max || min < 1 || max > 65535 {
+					return nil, nil, fmt.Errorf("invalid port range %q", s)
+				}
+				key.ports = append(key.ports, [2]int{min, max})
+			}
+		case "max-tunnels":
+			if key.maxTunnels, err = strconv.Atoi(value); err != nil {
+				return nil, nil, fmt.Errorf("invalid max-tunnels %q", value)
+			}
+		default:
+			return nil, nil, fmt.Errorf("unknown option %q", name)
+		}
+	}
+	return pub, key, nil
+}
+
+// splitOptions cut the options before key type, commas and spaces in quotes are kept
+func splitOptions(line string) (options, rest string) {
+	quoted := false
+	for i, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ' ' && !quoted:
+			return line[:i], strings.TrimSpace(line[i:])
+		}
+	}
+	return line, ""
+}
+
+func splitQuoted(options string) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i, c := range options {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			parts = append(parts, options[start:i])
+			start = i + 1
+		}
+	}
+	if start < len(options) {
+		parts = append(parts, options[start:])
+	}
+	return parts
+}
+
+// parseSSHPublicKey decode the wire format: string "ssh-ed25519", string key
+func parseSSHPublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	keyType, b, ok1 := readSSHString(b)
+	pub, _, ok2 := readSSHString(b)
+	if !ok1 || !ok2 || string(keyType) != "ssh-ed25519" || len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid ssh-ed25519 key")
+	}
+	return ed25519.PublicKey(pub), nil
+}
+
+// readSSHString read a length prefixed string of ssh wire format
+func readSSHString(b []byte) (s, rest []byte, ok bool) {
+	if len(b) < 4 || uint32(len(b)-4) < binary.BigEndian.Uint32(b) {
+		return nil, nil, false
+	}
+	n := 4 + binary.BigEndian.Uint32(b)
+	return b[4:n], b[n:], true
+}
+
+const openSSHKeyMagic = "openssh-key-v1\x00"
+
+// parseOpenSSHPrivateKey read an unencrypted ed25519 key made by ssh-keygen,
+// encrypted keys are not supported, ex: ssh-keygen -t ed25519 -N ""
+func parseOpenSSHPrivateKey(der []byte) (ed25519.PrivateKey, error) {
+	b, ok := bytes.CutPrefix(der, []byte(openSSHKeyMagic))
+	if !ok {
+		return nil, errors.New("invalid openssh private key")
+	}
+	var cipherName, private []byte
+	cipherName, b, ok = readSSHString(b)
+	for i := 0; ok && i < 2; i++ { // kdf name and options
+		_, b, ok = readSSHString(b)
+	}
+	if !ok || len(b) < 4 {
+		return nil, errors.New("invalid openssh private key")
+	}
+	if string(cipherName) != "none" {
+		return nil, errors.New("encrypted openssh private key is not supported, remove the passphrase of a copy")
+	}
+	if binary.BigEndian.Uint32(b) != 1 {
+		return nil, errors.New("openssh private key file should have one key")
+	}
+	_, b, ok = readSSHString(b[4:]) // public key
+	if ok {
+		private, _, ok = readSSHString(b)
+	}
+	if !ok || len(private) < 8 || !bytes.Equal(private[:4], private[4:8]) {
+		return nil, errors.New("invalid openssh private key")
+	}
+	keyType, b, ok1 := readSSHString(private[8:])
+	_, b, ok2 := readSSHString(b)
+	key, _, ok3 := readSSHString(b)
+	if !ok1 || !ok2 || !ok3 || string(keyType) != "ssh-ed25519" || len(key) != ed25519.PrivateKeySize {
+		return nil, errors.New("openssh private key is not ssh-ed25519")
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+// reservePort mark a free port taken until it is bound, false when it is in use
+func (ps *ProxyServer) reservePort(port int) bool {
+	ps.Lock()
+	defer ps.Unlock()
+	if _, used := ps.portGroups[port]; used || ps.reservedPorts[port] {
+		return false
+	}
+	ps.reservedPorts[port] = true
+	return true
+}
+
+// joinAllowedPort join port group on a port the key may use,
+// the first free port in ranges is taken when client does not ask for one
+func (ps *ProxyServer) joinAllowedPort(tunnel *webSocketTunnel, reqInfo *RequestInfo, key *authorizedKey) (*tunnelGroup, error) {
+	if key == nil || len(key.ports) == 0 {
+		return ps.joinPortGroup(tunnel, reqInfo)
+	}
+	if reqInfo.Port != 0 {
+		if !key.allowPort(reqInfo.Port) {
+			return nil, fmt.Errorf("%w: port %d", ErrKeyRestricted, reqInfo.Port)
+		}
+		return ps.joinPortGroup(tunnel, reqInfo)
+	}
+	// ports are reserved under lock and bound outside it, the hook only runs for the port picked
+	for _, r := range key.ports {
+		for port := r[0]; port <= r[1]; port++ {
+			if !ps.reservePort(port) {
+				continue
+			}
+			_, listener, err := listenPort(port)
+			ps.Lock()
+			delete(ps.reservedPorts, port)
+			if err != nil {
+				ps.Unlock()
+				continue
+			}
+			reqInfo.Port = port
+			group, err := ps.servePortGroup(tunnel, reqInfo, listener)
+			ps.Unlock()
+			return group, err
+		}
+	}
+	return nil, fmt.Errorf("%w: no free port in ranges", ErrKeyRestricted)
+}
@@ -0,0 +1,120 @@
+package pxlocal
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func sshPublicKey(pub ed25519.PublicKey) string {
+	return "ssh-ed25519 " + base64.StdEncoding.EncodeToString(appendSSHString(nil, []byte("ssh-ed25519"), pub))
+}
+
+func appendSSHString(b []byte, parts ...[]byte) []byte {
+	for _, part := range parts {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(part)))
+		b = append(b, part...)
+	}
+	return b
+}
+
+// openSSHPrivateKey encode key like ssh-keygen -t ed25519 -N ""
+func openSSHPrivateKey(key ed25519.PrivateKey, cipherName string) []byte {
+	pub := appendSSHString(nil, []byte("ssh-ed25519"), key.Public().(ed25519.PublicKey))
+	private := []byte{1, 2, 3, 4, 1, 2, 3, 4} // check ints
+	private = appendSSHString(private, []byte("ssh-ed25519"), key.Public().(ed25519.PublicKey), key, []byte("alice@laptop"))
+	for i := byte(1); len(private)%8 != 0; i++ {
+		private = append(private, i)
+	}
+	b := []byte(openSSHKeyMagic)
+	b = appendSSHString(b, []byte(cipherName), []byte("none"), nil)
+	b = binary.BigEndian.AppendUint32(b, 1)
+	b = appendSSHString(b, pub, private)
+	return pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: b})
+}
+
+func TestOpenSSHPrivateKey(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	dir := t.TempDir()
+
+	Convey("Load unencrypted openssh key", t, func() {
+		filename := filepath.Join(dir, "id_ed25519")
+		os.WriteFile(filename, openSSHPrivateKey(key, "none"), 0600)
+		loaded, err := LoadOrCreateIdentityKey(filename)
+		So(err, ShouldBeNil)
+		So(loaded.Equal(key), ShouldBeTrue)
+	})
+
+	Convey("Reject encrypted openssh key", t, func() {
+		filename := filepath.Join(dir, "id_ed25519_encrypted")
+		os.WriteFile(filename, openSSHPrivateKey(key, "aes256-ctr"), 0600)
+		_, err := LoadOrCreateIdentityKey(filename)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestAuthorizedKeys(t *testing.T) {
+	alice, _, _ := ed25519.GenerateKey(rand.Reader)
+	bob, _, _ := ed25519.GenerateKey(rand.Reader)
+	filename := filepath.Join(t.TempDir(), "authorized_keys")
+
+	Convey("Parse keys and options", t, func() {
+		os.WriteFile(filename, []byte("# comment\n"+
+			`protocols="http",subdomains="alice-*,blog",ports="40000-40010,45000",max-tunnels=2 `+sshPublicKey(alice)+" alice@laptop\n"), 0644)
+		ak, err := LoadAuthorizedKeys(filename)
+		So(err, ShouldBeNil)
+		key, err := ak.lookup(alice)
+		So(err, ShouldBeNil)
+		So(key.comment, ShouldEqual, "alice@laptop")
+		So(key.allowProtocol("http2"), ShouldBeNil)
+		So(errors.Is(key.allowProtocol("tcp"), ErrKeyRestricted), ShouldBeTrue)
+		So(key.identity.allowed("alice-x"), ShouldBeTrue)
+		So(key.identity.allowed("blog"), ShouldBeTrue)
+		So(key.identity.allowed("bob"), ShouldBeFalse)
+		So(key.allowPort(40005), ShouldBeTrue)
+		So(key.allowPort(45000), ShouldBeTrue)
+		So(key.allowPort(45001), ShouldBeFalse)
+		_, err = ak.lookup(bob)
+		So(err, ShouldEqual, ErrKeyNotAuthorized)
+
+		release1, err := ak.acquire(alice, key)
+		So(err, ShouldBeNil)
+		release2, err := ak.acquire(alice, key)
+		So(err, ShouldBeNil)
+		_, err = ak.acquire(alice, key)
+		So(errors.Is(err, ErrKeyRestricted), ShouldBeTrue)
+		release1()
+		release2()
+		So(ak.active, ShouldBeEmpty)
+	})
+
+	Convey("Reload keeps old keys when file is broken", t, func() {
+		os.WriteFile(filename, []byte("ed25519 "+encodePublicKey(alice)+"\n"), 0644)
+		ak, err := LoadAuthorizedKeys(filename)
+		So(err, ShouldBeNil)
+
+		os.WriteFile(filename, []byte("ed25519 "+encodePublicKey(bob)+"\n"), 0644)
+		So(ak.Reload(), ShouldBeNil)
+		_, err = ak.lookup(bob)
+		So(err, ShouldBeNil)
+		_, err = ak.lookup(alice)
+		So(err, ShouldEqual, ErrKeyNotAuthorized)
+
+		for _, line := range []string{"ssh-rsa AAAA", "ssh-ed25519 AAAA", "color=red ed25519 " + encodePublicKey(bob), "ports=9-1 ed25519 " + encodePublicKey(bob),
+			`ports="0" ed25519 ` + encodePublicKey(bob), `ports="65000-70000" ed25519 ` + encodePublicKey(bob),
+			`subdomains="bob-*," ed25519 ` + encodePublicKey(bob), `subdomains="*" ed25519 ` + encodePublicKey(bob)} {
+			os.WriteFile(filename, []byte(line+"\n"), 0644)
+			So(ak.Reload(), ShouldNotBeNil)
+		}
+		_, err = ak.lookup(bob)
+		So(err, ShouldBeNil)
+	})
+}
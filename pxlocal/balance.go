@@ -0,0 +1,167 @@
+package pxlocal
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobuild/log"
+)
+
+const LB_RANDOM = "random"
+
+// backend failed to dial is skipped for this duration
+const backendFailTimeout = 10 * time.Second
+
+var ErrNoBackend = errors.New("all local backends failed")
+
+type backend struct {
+	*upstream
+	tr          *http.Transport
+	active      atomic.Int64 // connections or requests in use
+	failedUntil atomic.Int64 // unix nano, passive failure detection
+}
+
+func (b *backend) available() bool {
+	return time.Now().UnixNano() >= b.failedUntil.Load()
+}
+
+// upstreamPool spread connections over local backends,
+// LocalAddr like 127.0.0.1:8001,127.0.0.1:8002 has two backends
+type upstreamPool struct {
+	backends []*backend
+	strategy string
+	mu       sync.Mutex
+	next     int
+}
+
+func newUpstreamPool(opts ProxyOptions) (*upstreamPool, error) {
+	pool := &upstreamPool{strategy: opts.LocalBalance}
+	for _, addr := range strings.Split(opts.LocalAddr, ",") {
+		o := opts
+		o.LocalAddr = strings.TrimSpace(addr)
+		up, err := newUpstream(o)
+		if err != nil {
+			return nil, err
+		}
+		pool.backends = append(pool.backends, &backend{upstream: up, tr: up.transport(opts.Proto)})
+	}
+	if len(pool.backends) > 1 && pool.first().network == "file" {
+		return nil, errors.New("static directory can not be load balanced")
+	}
+	return pool, nil
+}
+
+func (p *upstreamPool) first() *upstream {
+	return p.backends[0].upstream
+}
+
+// order return backends to try, preferred one first, failed ones last
+func (p *upstreamPool) order() []*backend {
+	n := len(p.backends)
+	var start int
+	switch p.strategy {
+	case LB_RANDOM:
+		start = rand.Intn(n)
+	case LB_LEAST_CONN:
+		for i, b := range p.backends {
+			if b.active.Load() < p.backends[start].active.Load() {
+				start = i
+			}
+		}
+	default:
+		p.mu.Lock()
+		start = p.next
+		p.next = (p.next + 1) % n
+		p.mu.Unlock()
+	}
+	var ok, failed []*backend
+	for i := 0; i < n; i++ {
+		b := p.backends[(start+i)%n]
+		if b.available() {
+			ok = append(ok, b)
+		} else {
+			failed = append(failed, b)
+		}
+	}
+	return append(ok, failed...)
+}
+
+func (p *upstreamPool) markFailed(b *backend, err error) {
+	if len(p.backends) > 1 {
+		log.Warnf("local backend %s failed: %v", b.addr, err)
+	}
+	b.failedUntil.Store(time.Now().Add(backendFailTimeout).UnixNano())
+}
+
+// dial connect a backend without tls handshake, try next one when dial fails
+func (p *upstreamPool) dial() (net.Conn, *backend, error) {
+	err := ErrNoBackend
+	for _, b := range p.order() {
+		var conn net.Conn
+		if conn, err = b.dialRaw(localDialTimeout); err != nil {
+			p.markFailed(b, err)
+			continue
+		}
+		b.active.Add(1)
+		return &memberConn{Conn: conn, active: &b.active}, b, nil
+	}
+	return nil, nil, err
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// RoundTrip send request to a backend, request is sent to next backend when dial fails
+func (p *upstreamPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody {
+		// transport close body on error, but nothing is read when dial fails,
+		// the incoming body is closed by http server
+		req.Body = io.NopCloser(req.Body)
+	}
+	err := ErrNoBackend
+	for _, b := range p.order() {
+		out := req.Clone(req.Context())
+		if out.Host == out.URL.Host {
+			out.Host = b.host
+		}
+		out.URL.Scheme, out.URL.Host = b.scheme, b.host
+		b.active.Add(1)
+		var resp *http.Response
+		resp, err = b.tr.RoundTrip(out)
+		if err != nil {
+			b.active.Add(-1)
+			if isDialError(err) {
+				p.markFailed(b, err)
+				continue
+			}
+			return nil, err
+		}
+		mb := &memberBody{ReadCloser: resp.Body, active: &b.active}
+		if rwc, ok := resp.Body.(io.ReadWriteCloser); ok {
+			resp.Body = &memberRWBody{memberBody: mb, w: rwc}
+		} else {
+			resp.Body = mb
+		}
+		return resp, nil
+	}
+	return nil, err
+}
+
+// probe is ok when any backend is healthy
+func (p *upstreamPool) probe(hc HealthCheck) (err error) {
+	for _, b := range p.backends {
+		if err = b.probe(hc); err == nil {
+			return nil
+		}
+	}
+	return err
+}
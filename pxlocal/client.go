@@ -1,6 +1,9 @@
 package pxlocal
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -10,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gobuild/log"
@@ -21,13 +25,19 @@ var (
 	ErrDialTCP          = errors.New("error dial tcp connection")
 	ErrUnknownProtocol  = errors.New("unknown protocol")
 	ErrPrototolRequired = errors.New("protocol required")
+	ErrTunnelExpired    = errors.New("tunnel expired")
+	ErrRemoteAddrWait   = errors.New("timeout waiting for remote address")
+	ErrShareDisabled    = errors.New("share links are not enabled for the tunnel")
+	ErrShareLinkWait    = errors.New("timeout waiting for share link")
 )
 
 type ProxyProtocol string
 
 const (
-	TCP  = ProxyProtocol("tcp")
-	HTTP = ProxyProtocol("http")
+	TCP    = ProxyProtocol("tcp")
+	HTTP   = ProxyProtocol("http")
+	HTTP2  = ProxyProtocol("http2")  // h2c end to end, used by gRPC
+	STATIC = ProxyProtocol("static") // serve local directory as http tunnel
 )
 
 type ProxyOptions struct {
@@ -36,10 +46,78 @@ type ProxyOptions struct {
 	Subdomain  string
 	ListenPort int
 	ExtraData  string
+	TTL        time.Duration // max lifetime of the tunnel, 0 means forever
+
+	// Protect http tunnel with a share link, visitors need to open the link once
+	ShareTTL  time.Duration
+	ShareOnce bool
+
+	// Send PROXY protocol header (v1 or v2) to local service, only used in tcp
+	ProxyProtocol string
+
+	// Host header send to local service: preserve, rewrite or a custom value
+	HostHeader string
+
+	// Map local origins in Location, Refresh and Set-Cookie back to the public url
+	RewriteResponse bool
+	// Also rewrite html and json body, body bigger then RewriteBodyLimit is skipped
+	RewriteBody      bool
+	RewriteBodyLimit int64
+
+	// Html shown to visitors when local service is down, used for http
+	MaintenancePage string
+
+	// Used when LocalAddr is https://... or tls://...
+	UpstreamTLS UpstreamTLS
+
+	// Used when Proto is static or LocalAddr is file://...
+	Static StaticOptions
+
+	HealthCheck HealthCheck
+
+	// Clients with the same group key share one subdomain or tcp port,
+	// LoadBalance is round-robin or least-conn, decided by the first member
+	GroupKey    string
+	LoadBalance string
+
+	// LocalBalance spread connections when LocalAddr has several comma separated addresses,
+	// round-robin, random or least-conn
+	LocalBalance string
+
+	// Register http tunnel on a path prefix of the subdomain, ex: /api,
+	// StripPrefix remove the prefix before forwarding to local service
+	PathPrefix  string
+	StripPrefix bool
+
+	// Serve http tunnel on a dedicated public port instead of subdomain,
+	// ListenPort is used when set
+	PortTunnel bool
+
+	// Also claim *.<subdomain>.<domain>
+	Wildcard bool
+	// Custom hostnames CNAME'd to the server, routed after server verified them
+	Hostnames []string
+
+	// Base domain of the tunnel, empty means the default of server,
+	// Token is checked by access policy of the domain
+	Domain string
+	Token  string
+	// Token of a user in the users file of server, the user owns subdomains with its prefixes
+	UserToken string
+
+	// Prove the client owns this key, server derive a stable subdomain from it
+	// when Subdomain is empty
+	IdentityKey ed25519.PrivateKey
+
+	// Register tcp tunnel only reachable by visitor clients (Client.Visit) knowing Secret,
+	// traffic is end to end encrypted, server only relays ciphertext
+	Private string
+	Secret  string
 }
 
 type Client struct {
-	sURL *url.URL
+	sURL      *url.URL
+	tlsConfig *tls.Config // nil means default of websocket dialer
 }
 
 // Proxy Client
@@ -58,7 +136,7 @@ func NewClient(serverAddr string) *Client {
 	case "http":
 		scheme = "ws"
 	}
-	return &Client{&url.URL{
+	return &Client{sURL: &url.URL{
 		Scheme: scheme,
 		Host:   u.Host,
 		Path:   "/ws",
@@ -70,6 +148,40 @@ type ProxyConnector struct {
 	err        error
 	wg         sync.WaitGroup
 	remoteAddr string
+	mu         sync.Mutex
+	ready      chan struct{} // closed when remote address is known
+	done       chan struct{}
+	writeMu    sync.Mutex
+	shareLinks chan string // links minted by NewShareLink
+}
+
+func (p *ProxyConnector) sendMessage(mType MessageType, text string) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	return p.wsConn.WriteJSON(&message{Type: mType, Body: text})
+}
+
+// NewShareLink ask server for another share link of the http tunnel,
+// only works when the tunnel is created with ShareTTL or ShareOnce
+func (p *ProxyConnector) NewShareLink(ttl time.Duration, once bool) (string, error) {
+	q := url.Values{"ttl": []string{strconv.Itoa(int(ttl.Seconds()))}}
+	if once {
+		q.Set("once", "1")
+	}
+	if err := p.sendMessage(TYPE_SHARE_MINT, q.Encode()); err != nil {
+		return "", err
+	}
+	select {
+	case link := <-p.shareLinks:
+		if link == "" {
+			return "", ErrShareDisabled
+		}
+		return link, nil
+	case <-p.done:
+		return "", ErrWebsocketBroken
+	case <-time.After(5 * time.Second):
+		return "", ErrShareLinkWait
+	}
 }
 
 func (p *ProxyConnector) Close() error {
@@ -82,58 +194,199 @@ func (p *ProxyConnector) Wait() error {
 }
 
 func (p *ProxyConnector) RemoteAddr() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	return p.remoteAddr
 }
 
+func (p *ProxyConnector) setRemoteAddr(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.remoteAddr = addr
+	select {
+	case <-p.ready:
+	default:
+		close(p.ready)
+	}
+}
+
+// WaitRemoteAddr block until server reports the public address of the tunnel
+func (p *ProxyConnector) WaitRemoteAddr(timeout time.Duration) (string, error) {
+	select {
+	case <-p.ready:
+		return p.RemoteAddr(), nil
+	case <-p.done:
+		if p.err != nil {
+			return "", p.err
+		}
+		return "", ErrWebsocketBroken
+	case <-time.After(timeout):
+		return "", ErrRemoteAddrWait
+	}
+}
+
 func (c *Client) URL() *url.URL {
 	return c.sURL
 }
 
-// This is a immediately return function
+// This is a immediately return function,
+// except it waits for local service when HealthCheck.WaitHealthy is set
 func (c *Client) RunProxy(opts ProxyOptions) (pc *ProxyConnector, err error) {
 	if opts.Proto == "" {
 		return nil, ErrPrototolRequired
 	}
+	switch opts.ProxyProtocol {
+	case "", PROXY_PROTOCOL_V1, PROXY_PROTOCOL_V2:
+	default:
+		return nil, ErrProxyProtocolVersion
+	}
+	if err := checkHostHeader(opts.HostHeader); err != nil {
+		return nil, err
+	}
+	if opts.Private != "" && opts.Proto != TCP {
+		return nil, fmt.Errorf("%w: private tunnel is tcp only", ErrUnknownProtocol)
+	}
+	if opts.Private != "" {
+		if err := checkSecret(opts.Secret); err != nil {
+			return nil, err
+		}
+	}
+	up, err := newUpstreamPool(opts)
+	if err != nil {
+		return nil, err
+	}
+	if up.first().network == "file" {
+		opts.Proto = STATIC
+	}
+	proto := opts.Proto
+	if proto == STATIC {
+		proto = HTTP // server only sees a http tunnel
+	}
+	if opts.HealthCheck.Type != "" && opts.HealthCheck.WaitHealthy {
+		up.waitHealthy(opts.HealthCheck)
+	}
 	q := c.sURL.Query()
-	q.Add("protocol", string(opts.Proto))
+	q.Add("protocol", string(proto))
 	q.Add("subdomain", opts.Subdomain)
 	q.Add("data", opts.ExtraData)
 	if opts.ListenPort != 0 {
 		q.Add("port", strconv.Itoa(opts.ListenPort))
 	}
+	if opts.TTL > 0 {
+		q.Add("ttl", strconv.Itoa(int(opts.TTL/time.Second)))
+	}
+	if opts.ShareTTL > 0 {
+		q.Add("share_ttl", strconv.Itoa(int(opts.ShareTTL/time.Second)))
+	}
+	if opts.ShareOnce {
+		q.Add("share_once", "1")
+	}
+	if opts.PortTunnel {
+		q.Add("port_tunnel", "1")
+	}
+	if opts.Domain != "" {
+		q.Add("domain", opts.Domain)
+	}
+	if opts.Token != "" {
+		q.Add("token", opts.Token)
+	}
+	if opts.UserToken != "" {
+		q.Add("user_token", opts.UserToken)
+	}
+	if opts.IdentityKey != nil {
+		q.Add("pubkey", encodePublicKey(opts.IdentityKey.Public().(ed25519.PublicKey)))
+	}
+	if opts.Private != "" {
+		q.Add("private", opts.Private) // secret never leaves the client
+	}
+	if opts.Wildcard {
+		q.Add("wildcard", "1")
+	}
+	for _, hostname := range opts.Hostnames {
+		q.Add("hostname", hostname)
+	}
+	if opts.PathPrefix != "" {
+		q.Add("path", opts.PathPrefix)
+		if opts.StripPrefix {
+			q.Add("strip_path", "1")
+		}
+	}
+	if opts.GroupKey != "" {
+		q.Add("group", opts.GroupKey)
+		q.Add("lb", opts.LoadBalance)
+	}
 	c.sURL.RawQuery = q.Encode()
 
-	wsclient, _, err := websocket.DefaultDialer.Dial(c.sURL.String(), nil)
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = c.tlsConfig
+	wsclient, _, err := dialer.Dial(c.sURL.String(), nil)
 	if err != nil {
 		return nil, err
 	}
-	pc = &ProxyConnector{wsConn: wsclient}
+	if opts.IdentityKey != nil {
+		if err := answerChallenge(wsclient, opts.IdentityKey, c.sURL.Host); err != nil {
+			wsclient.Close()
+			return nil, err
+		}
+	}
+	if opts.MaintenancePage != "" {
+		if err := wsclient.WriteJSON(&message{Type: TYPE_MAINTENANCE, Body: opts.MaintenancePage}); err != nil {
+			wsclient.Close()
+			return nil, err
+		}
+	}
+	pc = &ProxyConnector{
+		wsConn:     wsclient,
+		ready:      make(chan struct{}),
+		done:       make(chan struct{}),
+		shareLinks: make(chan string),
+	}
 	pc.wg.Add(1)
-	go idleWsSend(wsclient) // keep websocket alive to prevent nginx timeout issue
+	go pc.idleWsSend() // keep websocket alive to prevent nginx timeout issue
+	if opts.HealthCheck.Type != "" {
+		go pc.healthLoop(up, opts.HealthCheck)
+	}
 	go func() {
 		defer wsclient.Close()
 		revListener := newRevNetListener()
 		defer revListener.Close()
 		defer pc.wg.Done()
+		defer close(pc.done)
 
-		go serveRevConn(opts.Proto, opts.LocalAddr, revListener)
+		var lis net.Listener = revListener
+		if opts.Private != "" {
+			lis = newE2EListener(revListener, opts.Private, opts.Secret)
+		}
+		go serveRevConn(opts, up, lis)
 		for {
 			var msg message
 			if err := wsclient.ReadJSON(&msg); err != nil {
 				pc.err = err
 				return
 			}
-			go handleWsMsg(msg, c.sURL, revListener) // send new conn to rnl
+			if msg.Type == TYPE_REMOTEADDR {
+				pc.setRemoteAddr(msg.Body)
+			}
+			if msg.Type == TYPE_SHARELINK {
+				select {
+				case pc.shareLinks <- msg.Body: // someone is waiting in NewShareLink
+				default:
+				}
+			}
+			if msg.Type == TYPE_EXPIRED {
+				fmt.Printf("Tunnel expired after %s\n", msg.Body)
+				pc.err = ErrTunnelExpired
+				return
+			}
+			go handleWsMsg(msg, c.sURL, c.tlsConfig, revListener) // send new conn to rnl
 		}
 	}()
 	return pc, nil
 }
 
-func idleWsSend(wsc *websocket.Conn) {
-	var msg message
-	msg.Type = TYPE_IDLE
+func (p *ProxyConnector) idleWsSend() {
 	for {
-		if err := wsc.WriteJSON(&msg); err != nil {
+		if err := p.sendMessage(TYPE_IDLE, ""); err != nil {
 			break
 		}
 		time.Sleep(5 * time.Second)
@@ -169,7 +422,7 @@ func (r *reverseNetListener) Close() error {
 // msg comes from px server by websocket
 // 1: connect to px server, use msg.Name to identify self.
 // 2: change conn to reverse conn
-func handleWsMsg(msg message, sURL *url.URL, rnl *reverseNetListener) {
+func handleWsMsg(msg message, sURL *url.URL, tlsConfig *tls.Config, rnl *reverseNetListener) {
 	switch msg.Type {
 	case TYPE_NEWCONN:
 		log.Debugf("New Connection: %s", msg.Body)
@@ -178,24 +431,90 @@ func handleWsMsg(msg message, sURL *url.URL, rnl *reverseNetListener) {
 		}
 		wsURL := *sURL
 		wsURL.Path = "/ws/reverse"
-		wsConn, _, err := websocket.DefaultDialer.Dial(wsURL.String(), requestHeader)
+		sconn, err := dialReverseConn(wsURL.String(), requestHeader, tlsConfig)
 		if err != nil {
 			log.Error("Websocket dial error:", err)
 			return
 		}
-		sconn := wsConn.NetConn()
-		rnl.connCh <- sconn
+		// body is the visitor address and a token of the request
+		proxyFor, _, _ := strings.Cut(msg.Body, " ")
+		rnl.connCh <- &revConn{Conn: sconn, proxyFor: proxyFor}
 	case TYPE_MESSAGE:
 		fmt.Printf("Recv Message: %v\n", msg.Body)
 	case TYPE_REMOTEADDR:
 		fmt.Printf("Local server is now publicly available via: %s\n", msg.Body)
+	case TYPE_SHARELINK:
+		if msg.Body != "" {
+			fmt.Printf("Share link: %s\n", msg.Body)
+		}
 	default:
 		log.Warnf("Type: %v not support", msg.Type)
 	}
 }
 
-func serveRevConn(proto ProxyProtocol, pAddr string, lis net.Listener) error {
-	switch proto {
+// handshakeConn reads one byte at a time until the websocket handshake is done,
+// so bytes sent right after the handshake response are not swallowed by the
+// buffered reader of websocket, which is dropped when the raw conn is used.
+type handshakeConn struct {
+	net.Conn
+	done atomic.Bool
+}
+
+func (c *handshakeConn) Read(b []byte) (int, error) {
+	if !c.done.Load() && len(b) > 1 {
+		b = b[:1]
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *handshakeConn) CloseRead() error  { return closeRead(c.Conn) }
+func (c *handshakeConn) CloseWrite() error { return closeWrite(c.Conn) }
+
+// dialReverseConn create a websocket and return the raw connection of it
+func dialReverseConn(wsURL string, header http.Header, tlsConfig *tls.Config) (net.Conn, error) {
+	var hconn *handshakeConn
+	dialer := *websocket.DefaultDialer
+	dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		hconn = &handshakeConn{Conn: conn}
+		return hconn, nil
+	}
+	// tls is done here, so the handshake guard is above tls instead of under it
+	dialer.NetDialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg := &tls.Config{}
+		if tlsConfig != nil {
+			cfg = tlsConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		hconn = &handshakeConn{Conn: tlsConn}
+		return hconn, nil
+	}
+	wsConn, _, err := dialer.Dial(wsURL, header)
+	if err != nil {
+		return nil, err
+	}
+	hconn.done.Store(true)
+	return wsConn.NetConn(), nil
+}
+
+func serveRevConn(opts ProxyOptions, pool *upstreamPool, lis net.Listener) error {
+	up := pool.first()
+	pAddr := up.host
+	switch opts.Proto {
 	case TCP:
 		for {
 			rconn, err := lis.Accept()
@@ -203,12 +522,30 @@ func serveRevConn(proto ProxyProtocol, pAddr string, lis net.Listener) error {
 				log.Errorf("accept error: %v", err)
 				return err
 			}
-			log.Info("local dial tcp", pAddr)
-			lconn, err := net.Dial("tcp", pAddr)
+			lconn, b, err := pool.dial()
 			if err != nil {
-				log.Warn(err)
+				// keep serving, local service may come back later
+				log.Warnf("local dial error: %v", err)
 				rconn.Close()
-				return err
+				continue
+			}
+			if opts.ProxyProtocol != "" {
+				dst, ok := lconn.RemoteAddr().(*net.TCPAddr)
+				if !ok { // unix socket
+					dst = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+				}
+				if err := writeProxyHeader(lconn, opts.ProxyProtocol, visitorAddr(rconn), dst); err != nil {
+					log.Warnf("write proxy protocol header: %v", err)
+					lconn.Close()
+					rconn.Close()
+					continue
+				}
+			}
+			log.Info("local dial", b.network, b.addr)
+			if lconn, err = b.wrap(lconn); err != nil {
+				log.Warnf("local tls handshake: %v", err)
+				rconn.Close()
+				continue
 			}
 			// start forward local proxy
 			pc := &proxyConn{
@@ -218,17 +555,51 @@ func serveRevConn(proto ProxyProtocol, pAddr string, lis net.Listener) error {
 			}
 			go pc.start()
 		}
-	case HTTP:
+	case HTTP, HTTP2:
 		rp := &httputil.ReverseProxy{
-			Director: func(req *http.Request) {
-				req.Host = pAddr
-				req.URL.Scheme = "http"
-				req.URL.Host = pAddr
+			FlushInterval: -1, // flush immediately, required by server-sent events
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				copyForwardedHeaders(pr.Out.Header, pr.In.Header)
+				pr.Out.Host = hostHeader(opts.HostHeader, pr.In.Host, pAddr)
+				pr.Out.URL.Scheme = up.scheme
+				pr.Out.URL.Host = pAddr
+				if opts.RewriteBody {
+					pr.Out.Header.Del("Accept-Encoding") // body must be plain text to rewrite
+				}
 			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				log.Warnf("local service error: %v", err)
+				kind := localErrorKind(err)
+				w.Header().Set(headerProxylocalError, kind)
+				w.WriteHeader(errorPageInfos[kind].status)
+			},
+		}
+		var rw *responseRewriter
+		if opts.RewriteResponse || opts.RewriteBody {
+			rw = newResponseRewriter(pAddr, opts.RewriteBody, opts.RewriteBodyLimit)
+			for _, b := range pool.backends[1:] {
+				rw.addLocal(b.host)
+			}
+		}
+		rp.ModifyResponse = func(resp *http.Response) error {
+			// only the error handler above may ask server for an error page
+			resp.Header.Del(headerProxylocalError)
+			if rw != nil {
+				return rw.ModifyResponse(resp)
+			}
+			return nil
+		}
+		rp.Transport = pool
+		srv := &http.Server{Handler: rp}
+		if opts.Proto == HTTP2 {
+			srv.Protocols = h2cProtocols()
 		}
-		return http.Serve(lis, rp)
+		return srv.Serve(lis)
+	case STATIC:
+		log.Infof("serve static files in %s", up.addr)
+		return http.Serve(lis, newStaticHandler(up.addr, opts.Static))
 	default:
-		log.Println("Unknown protocol:", proto)
+		log.Println("Unknown protocol:", opts.Proto)
 		return ErrUnknownProtocol
 	}
 }
@@ -0,0 +1,335 @@
+package pxlocal
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobuild/log"
+)
+
+const (
+	dnsTypeA    = 1
+	dnsTypeNS   = 2
+	dnsTypeSOA  = 6
+	dnsTypeTXT  = 16
+	dnsTypeAAAA = 28
+	dnsTypeANY  = 255
+	dnsClassIN  = 1
+
+	dnsRcodeOK       = 0
+	dnsRcodeFormErr  = 1
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImpl  = 4
+	dnsRcodeRefused  = 5
+
+	dnsHeaderLen  = 12
+	dnsMaxUDPSize = 512
+)
+
+var errDNSFormat = errors.New("malformed dns message")
+
+// DNSServer is an authoritative dns server for base domains of the proxy server,
+// the domain and all its subdomains point to the proxy server
+type DNSServer struct {
+	IPs    []net.IP // answered in A and AAAA records
+	TTL    uint32   // default 60
+	Strict bool     // NXDOMAIN for subdomains without tunnel
+
+	ps  *ProxyServer
+	mu  sync.RWMutex
+	txt map[string][]string
+}
+
+func NewDNSServer(ps *ProxyServer, ips []net.IP) *DNSServer {
+	return &DNSServer{IPs: ips, TTL: 60, ps: ps, txt: make(map[string][]string)}
+}
+
+// SetTXT set txt records of name, ex: _acme-challenge.example.com for ACME DNS-01,
+// no values remove the records
+func (s *DNSServer) SetTXT(name string, values ...string) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(values) == 0 {
+		delete(s.txt, name)
+	} else {
+		s.txt[name] = values
+	}
+}
+
+func (s *DNSServer) txtRecords(name string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.txt[name]
+}
+
+// ListenAndServe serve dns on both udp and tcp of addr, ex: :53
+func (s *DNSServer) ListenAndServe(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	errC := make(chan error, 2)
+	go func() { errC <- s.ServeUDP(pc) }()
+	go func() { errC <- s.ServeTCP(l) }()
+	err = <-errC
+	pc.Close()
+	l.Close()
+	return err
+}
+
+func (s *DNSServer) ServeUDP(pc net.PacketConn) error {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		resp := s.handle(buf[:n])
+		if resp == nil {
+			continue
+		}
+		if len(resp) > dnsMaxUDPSize {
+			resp = truncate(resp)
+		}
+		pc.WriteTo(resp, addr)
+	}
+}
+
+func (s *DNSServer) ServeTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveTCPConn(conn)
+	}
+}
+
+// dns over tcp prefix every message with 2 bytes length
+func (s *DNSServer) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		var size uint16
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		req := make([]byte, size)
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		resp := s.handle(req)
+		if resp == nil {
+			return
+		}
+		out := binary.BigEndian.AppendUint16(nil, uint16(len(resp)))
+		if _, err := conn.Write(append(out, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+type dnsQuestion struct {
+	name   string // lower case, without trailing dot
+	qtype  uint16
+	qclass uint16
+	end    int // offset after the question
+}
+
+// parseQuestion read the first question, compressed names are not expected in queries
+func parseQuestion(msg []byte) (q dnsQuestion, err error) {
+	off := dnsHeaderLen
+	var labels []string
+	for {
+		if off >= len(msg) {
+			return q, errDNSFormat
+		}
+		n := int(msg[off])
+		off++
+		if n == 0 {
+			break
+		}
+		if n > 63 || off+n > len(msg) {
+			return q, errDNSFormat
+		}
+		labels = append(labels, strings.ToLower(string(msg[off:off+n])))
+		off += n
+	}
+	if off+4 > len(msg) {
+		return q, errDNSFormat
+	}
+	q.name = strings.Join(labels, ".")
+	q.qtype = binary.BigEndian.Uint16(msg[off:])
+	q.qclass = binary.BigEndian.Uint16(msg[off+2:])
+	q.end = off + 4
+	return q, nil
+}
+
+// handle build the response of a query, nil means no response
+func (s *DNSServer) handle(req []byte) []byte {
+	if len(req) < dnsHeaderLen || req[2]&0x80 != 0 { // too short or not a query
+		return nil
+	}
+	opcode := (req[2] >> 3) & 0x0f
+	qdcount := binary.BigEndian.Uint16(req[4:])
+	q, err := parseQuestion(req)
+	switch {
+	case err != nil || qdcount != 1:
+		return dnsHeader(req, dnsRcodeFormErr, false, 0, 0)
+	case opcode != 0:
+		return dnsHeader(req, dnsRcodeNotImpl, false, 0, 0)
+	}
+	resp := dnsHeader(req, dnsRcodeOK, true, 0, 0)
+	resp = append(resp, req[dnsHeaderLen:q.end]...)
+
+	d := s.ps.baseDomainOf(q.name)
+	if d == nil || q.qclass != dnsClassIN {
+		log.Debugf("dns refused %s", q.name)
+		return setCounts(setRcode(resp, dnsRcodeRefused, false), 1, 0, 0)
+	}
+	if !s.exists(q.name, d.Name) {
+		resp = appendSOA(resp, d.Name, s.TTL)
+		return setCounts(setRcode(resp, dnsRcodeNXDomain, true), 1, 0, 1)
+	}
+	var answers uint16
+	if q.qtype == dnsTypeA || q.qtype == dnsTypeAAAA || q.qtype == dnsTypeANY {
+		for _, ip := range s.IPs {
+			if ip4 := ip.To4(); ip4 != nil && q.qtype != dnsTypeAAAA {
+				resp = appendRR(resp, dnsTypeA, s.TTL, ip4)
+				answers++
+			} else if ip4 == nil && q.qtype != dnsTypeA {
+				resp = appendRR(resp, dnsTypeAAAA, s.TTL, ip.To16())
+				answers++
+			}
+		}
+	}
+	if q.qtype == dnsTypeTXT || q.qtype == dnsTypeANY {
+		for _, value := range s.txtRecords(q.name) {
+			resp = appendRR(resp, dnsTypeTXT, s.TTL, txtData(value))
+			answers++
+		}
+	}
+	if (q.qtype == dnsTypeNS || q.qtype == dnsTypeANY) && q.name == d.Name {
+		resp = appendRR(resp, dnsTypeNS, s.TTL, appendName(nil, nameServer(d.Name)))
+		answers++
+	}
+	if q.qtype == dnsTypeSOA && q.name == d.Name {
+		resp = appendSOA(resp, d.Name, s.TTL)
+		return setCounts(resp, 1, 1, 0)
+	}
+	if answers == 0 { // no data, authority section tells negative ttl
+		resp = appendSOA(resp, d.Name, s.TTL)
+		return setCounts(resp, 1, 0, 1)
+	}
+	return setCounts(resp, 1, answers, 0)
+}
+
+// exists is true for the base domain, its name server, acme records, and tunnels when strict
+func (s *DNSServer) exists(name, base string) bool {
+	if !s.Strict || name == base || name == nameServer(base) || len(s.txtRecords(name)) > 0 {
+		return true
+	}
+	return s.ps.routes.hasHost(name)
+}
+
+func dnsHeader(req []byte, rcode byte, authoritative bool, qd, an uint16) []byte {
+	h := make([]byte, dnsHeaderLen)
+	copy(h[:2], req[:2])                  // id
+	h[2] = 0x80 | (req[2] & 0x79)         // QR, opcode, RD
+	h = setRcode(h, rcode, authoritative) // AA, rcode
+	return setCounts(h, qd, an, 0)
+}
+
+func setRcode(msg []byte, rcode byte, authoritative bool) []byte {
+	if authoritative {
+		msg[2] |= 0x04
+	} else {
+		msg[2] &^= 0x04
+	}
+	msg[3] = rcode & 0x0f
+	return msg
+}
+
+func setCounts(msg []byte, qd, an, ns uint16) []byte {
+	binary.BigEndian.PutUint16(msg[4:], qd)
+	binary.BigEndian.PutUint16(msg[6:], an)
+	binary.BigEndian.PutUint16(msg[8:], ns)
+	binary.BigEndian.PutUint16(msg[10:], 0)
+	return msg
+}
+
+// truncate keep only the question and set TC, client retry with tcp
+func truncate(resp []byte) []byte {
+	q, err := parseQuestion(resp)
+	if err != nil {
+		return resp[:dnsHeaderLen]
+	}
+	resp = setCounts(resp[:q.end], 1, 0, 0)
+	resp[2] |= 0x02
+	return resp
+}
+
+// appendRR append a record owned by the question name, 0xc00c points to it
+func appendRR(msg []byte, rtype uint16, ttl uint32, data []byte) []byte {
+	msg = append(msg, 0xc0, dnsHeaderLen)
+	msg = binary.BigEndian.AppendUint16(msg, rtype)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	msg = binary.BigEndian.AppendUint32(msg, ttl)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(data)))
+	return append(msg, data...)
+}
+
+func appendSOA(msg []byte, zone string, ttl uint32) []byte {
+	msg = appendName(msg, zone)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeSOA)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	msg = binary.BigEndian.AppendUint32(msg, ttl)
+	rdata := appendName(nil, nameServer(zone))
+	rdata = appendName(rdata, "hostmaster."+zone)
+	for _, v := range []uint32{1, 3600, 600, 86400, ttl} { // serial, refresh, retry, expire, minimum
+		rdata = binary.BigEndian.AppendUint32(rdata, v)
+	}
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+	return append(msg, rdata...)
+}
+
+// nameServer is this server in NS and SOA records of zone, it resolves to IPs like other names
+func nameServer(zone string) string {
+	return "ns." + zone
+}
+
+func appendName(msg []byte, name string) []byte {
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			continue
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0)
+}
+
+// txtData split value into character strings of at most 255 bytes
+func txtData(value string) []byte {
+	var data []byte
+	for {
+		n := min(len(value), 255)
+		data = append(data, byte(n))
+		data = append(data, value[:n]...)
+		value = value[n:]
+		if value == "" {
+			return data
+		}
+	}
+}
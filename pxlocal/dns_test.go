@@ -0,0 +1,66 @@
+package pxlocal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"testing"
+)
+
+func TestDNSServer(t *testing.T) {
+	ps := NewProxyServer(testDomain)
+	ps.routes.add(&route{host: "foo." + testDomain})
+	ps.routes.add(&route{host: "*.bar." + testDomain})
+	dns := NewDNSServer(ps, []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")})
+	dns.Strict = true
+	dns.SetTXT("_acme-challenge."+testDomain, "token")
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go dns.ServeUDP(pc)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go dns.ServeTCP(l)
+
+	for network, addr := range map[string]string{"udp": pc.LocalAddr().String(), "tcp": l.Addr().String()} {
+		resolver := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		}
+		ctx := context.Background()
+		for _, host := range []string{testDomain, "foo." + testDomain, "x.bar." + testDomain} {
+			addrs, err := resolver.LookupHost(ctx, host)
+			sort.Strings(addrs)
+			if err != nil || len(addrs) != 2 || addrs[0] != "192.0.2.1" || addrs[1] != "2001:db8::1" {
+				t.Errorf("%s: lookup %s got %v, err %v", network, host, addrs, err)
+			}
+		}
+		var dnsErr *net.DNSError
+		if _, err := resolver.LookupHost(ctx, "nope."+testDomain); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("%s: expect NXDOMAIN in strict mode, but got %v", network, err)
+		}
+		ns, err := resolver.LookupNS(ctx, testDomain)
+		if err != nil || len(ns) != 1 || ns[0].Host != "ns."+testDomain+"." {
+			t.Errorf("%s: lookup ns got %v, err %v", network, ns, err)
+		}
+		if addrs, err := resolver.LookupHost(ctx, "ns."+testDomain); err != nil || len(addrs) != 2 {
+			t.Errorf("%s: expect name server resolved in strict mode, but got %v, err %v", network, addrs, err)
+		}
+		txt, err := resolver.LookupTXT(ctx, "_acme-challenge."+testDomain)
+		if err != nil || len(txt) != 1 || txt[0] != "token" {
+			t.Errorf("%s: lookup txt got %v, err %v", network, txt, err)
+		}
+		if _, err := resolver.LookupHost(ctx, "example.com"); err == nil {
+			t.Errorf("%s: expect other domain refused", network)
+		}
+	}
+}
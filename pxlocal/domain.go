@@ -0,0 +1,157 @@
+package pxlocal
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrUnknownDomain   = errors.New("unknown domain")
+	ErrDomainForbidden = errors.New("access to domain denied")
+)
+
+// DomainConfig is a base domain served by the proxy server, tunnels are its subdomains
+type DomainConfig struct {
+	Name      string
+	Protocols []string // allowed protocols, empty means all
+	Tokens    []string // client must send one of them, empty means open to everyone
+	CertFile  string   // tls certificate for the domain and its subdomains
+	KeyFile   string
+}
+
+// ParseDomainConfig parse name[,protocols=http+tcp][,token=xx][,cert=file,key=file],
+// token can be repeated
+func ParseDomainConfig(spec string) (dc DomainConfig, err error) {
+	fields := strings.Split(spec, ",")
+	dc.Name = strings.ToLower(strings.TrimSpace(fields[0]))
+	if dc.Name == "" {
+		return dc, errors.New("domain name required")
+	}
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return dc, fmt.Errorf("invalid domain option %q", field)
+		}
+		switch key {
+		case "protocols":
+			dc.Protocols = strings.Split(value, "+")
+		case "token":
+			dc.Tokens = append(dc.Tokens, value)
+		case "cert":
+			dc.CertFile = value
+		case "key":
+			dc.KeyFile = value
+		default:
+			return dc, fmt.Errorf("unknown domain option %q", key)
+		}
+	}
+	return dc, nil
+}
+
+type baseDomain struct {
+	DomainConfig
+	cert *tls.Certificate
+}
+
+// allow check access policy of the domain
+func (d *baseDomain) allow(protocol, token string) error {
+	if len(d.Protocols) > 0 {
+		ok := false
+		for _, p := range d.Protocols {
+			// http2 and https tunnels are served as http
+			if p == protocol || (p == "http" && (protocol == "http2" || protocol == "https")) {
+				ok = true
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%w: protocol %s is not allowed on %s", ErrDomainForbidden, protocol, d.Name)
+		}
+	}
+	if len(d.Tokens) > 0 {
+		for _, t := range d.Tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: invalid token for %s", ErrDomainForbidden, d.Name)
+	}
+	return nil
+}
+
+// AddDomain serve another base domain, config of an existing domain is replaced
+func (ps *ProxyServer) AddDomain(dc DomainConfig) error {
+	d := &baseDomain{DomainConfig: dc}
+	if dc.CertFile != "" || dc.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(dc.CertFile, dc.KeyFile)
+		if err != nil {
+			return err
+		}
+		d.cert = &cert
+	}
+	ps.Lock()
+	defer ps.Unlock()
+	ps.domains[dc.Name] = d
+	return nil
+}
+
+// SetDefaultDomain set the domain used when client does not ask for one
+func (ps *ProxyServer) SetDefaultDomain(name string) error {
+	ps.Lock()
+	defer ps.Unlock()
+	if ps.domains[name] == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownDomain, name)
+	}
+	ps.domain = name
+	return nil
+}
+
+func (ps *ProxyServer) lookupDomain(name string) (*baseDomain, error) {
+	ps.RLock()
+	defer ps.RUnlock()
+	if name == "" {
+		name = ps.domain
+	}
+	d := ps.domains[strings.ToLower(name)]
+	if d == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownDomain, name)
+	}
+	return d, nil
+}
+
+// baseDomainOf return the base domain host belongs to, the longest one wins
+func (ps *ProxyServer) baseDomainOf(host string) *baseDomain {
+	ps.RLock()
+	defer ps.RUnlock()
+	var best *baseDomain
+	for name, d := range ps.domains {
+		if (host == name || strings.HasSuffix(host, "."+name)) && (best == nil || len(name) > len(best.Name)) {
+			best = d
+		}
+	}
+	return best
+}
+
+// TLSConfig pick certificate of base domains by SNI, used to serve https visitors,
+// client certificates are asked when ClientCAs is set
+func (ps *ProxyServer) TLSConfig() *tls.Config {
+	cfg := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if d := ps.baseDomainOf(strings.ToLower(hello.ServerName)); d != nil && d.cert != nil {
+				return d.cert, nil
+			}
+			d, err := ps.lookupDomain("")
+			if err == nil && d.cert != nil {
+				return d.cert, nil
+			}
+			return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+		},
+	}
+	if ps.ClientCAs != nil {
+		cfg.ClientCAs = ps.ClientCAs
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg
+}
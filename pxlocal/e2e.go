@@ -0,0 +1,354 @@
+package pxlocal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gobuild/log"
+)
+
+var (
+	ErrSecretRequired = errors.New("secret required for private tunnel")
+	ErrSecretWeak     = fmt.Errorf("secret of private tunnel should have at least %d characters", e2eMinSecret)
+	ErrE2EHandshake   = errors.New("end to end handshake failed")
+	ErrE2ETruncated   = errors.New("end to end stream closed without close record")
+	ErrPrivateTunnel  = errors.New("private tunnel not found")
+)
+
+const (
+	e2eInfo      = "proxylocal-e2e:"
+	e2eConfirm   = "proxylocal-e2e-ok"
+	e2eMaxRecord = 16 * 1024
+	// the relay server sees one handshake and may guess the secret offline,
+	// so short human secrets are not accepted
+	e2eMinSecret = 16
+)
+
+// checkSecret reject secrets too short to resist offline guessing
+func checkSecret(secret string) error {
+	if secret == "" {
+		return ErrSecretRequired
+	}
+	if len(secret) < e2eMinSecret {
+		return ErrSecretWeak
+	}
+	return nil
+}
+
+// GenerateSecret return a random secret for private tunnels
+func GenerateSecret() string {
+	return randomToken()
+}
+
+// secureConn is the end to end encrypted stream between visitor client and private tunnel client,
+// every record is a 2 bytes length and AES-GCM sealed data, nonce is the record counter.
+// An empty record closes the direction, so the relay can not truncate the stream unnoticed.
+type secureConn struct {
+	net.Conn
+
+	rmu     sync.Mutex
+	raead   cipher.AEAD
+	rseq    uint64
+	rbuf    []byte // opened but not read yet
+	rclosed bool   // close record received
+
+	wmu     sync.Mutex
+	waead   cipher.AEAD
+	wseq    uint64
+	wclosed bool // close record sent
+}
+
+// e2eHandshake exchange X25519 ephemeral keys, record keys are derived from the shared key and secret,
+// so the relay server can not decrypt or forge records without the secret.
+// Visitor is the initiator, both sides confirm the keys before any data.
+func e2eHandshake(conn net.Conn, name, secret string, initiator bool) (*secureConn, error) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(priv.PublicKey().Bytes()); err != nil {
+		return nil, err
+	}
+	peerBytes := make([]byte, 32)
+	if _, err := io.ReadFull(conn, peerBytes); err != nil {
+		return nil, err
+	}
+	peer, err := ecdh.X25519().NewPublicKey(peerBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrE2EHandshake, err)
+	}
+	shared, err := priv.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrE2EHandshake, err)
+	}
+	ei, er := priv.PublicKey().Bytes(), peerBytes
+	if !initiator {
+		ei, er = er, ei
+	}
+	keys, err := hkdf.Key(sha256.New, shared, []byte(secret), e2eInfo+name+string(ei)+string(er), 64)
+	if err != nil {
+		return nil, err
+	}
+	iKey, rKey := keys[:32], keys[32:]
+	if !initiator {
+		iKey, rKey = rKey, iKey
+	}
+	sc := &secureConn{Conn: conn}
+	if sc.waead, err = newGCM(iKey); err != nil {
+		return nil, err
+	}
+	if sc.raead, err = newGCM(rKey); err != nil {
+		return nil, err
+	}
+	if _, err := sc.Write([]byte(e2eConfirm)); err != nil {
+		return nil, err
+	}
+	confirm := make([]byte, len(e2eConfirm))
+	if _, err := io.ReadFull(sc, confirm); err != nil || subtle.ConstantTimeCompare(confirm, []byte(e2eConfirm)) != 1 {
+		return nil, fmt.Errorf("%w: wrong secret", ErrE2EHandshake)
+	}
+	return sc, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func recordNonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+// writeRecord seal and send one record, wmu must be held
+func (c *secureConn) writeRecord(chunk []byte) error {
+	record := make([]byte, 2, 2+len(chunk)+c.waead.Overhead())
+	record = c.waead.Seal(record, recordNonce(c.wseq), chunk, nil)
+	binary.BigEndian.PutUint16(record, uint16(len(record)-2))
+	c.wseq++
+	_, err := c.Conn.Write(record)
+	return err
+}
+
+func (c *secureConn) Write(b []byte) (n int, err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.wclosed {
+		return 0, net.ErrClosed
+	}
+	for len(b) > 0 {
+		chunk := b[:min(len(b), e2eMaxRecord)]
+		if err := c.writeRecord(chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+func (c *secureConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.rbuf) == 0 {
+		if c.rclosed {
+			return 0, io.EOF
+		}
+		var size uint16
+		if err := binary.Read(c.Conn, binary.BigEndian, &size); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return 0, ErrE2ETruncated
+			}
+			return 0, err
+		}
+		record := make([]byte, size)
+		if _, err := io.ReadFull(c.Conn, record); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return 0, ErrE2ETruncated
+			}
+			return 0, err
+		}
+		plain, err := c.raead.Open(record[:0], recordNonce(c.rseq), record, nil)
+		if err != nil {
+			return 0, fmt.Errorf("%w: record authentication failed", ErrE2EHandshake)
+		}
+		c.rseq++
+		c.rbuf = plain
+		c.rclosed = len(plain) == 0 // data records are never empty
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *secureConn) CloseRead() error {
+	return closeRead(c.Conn)
+}
+
+// CloseWrite send the close record before closing the write side
+func (c *secureConn) CloseWrite() error {
+	c.wmu.Lock()
+	if !c.wclosed {
+		c.wclosed = true
+		c.writeRecord(nil)
+	}
+	c.wmu.Unlock()
+	return closeWrite(c.Conn)
+}
+
+// e2eListener accept reverse connections of private tunnel,
+// handshakes run concurrently so a slow visitor does not block others
+type e2eListener struct {
+	net.Listener
+	conns chan net.Conn
+	done  chan struct{}
+	err   error
+}
+
+func newE2EListener(lis net.Listener, name, secret string) *e2eListener {
+	l := &e2eListener{Listener: lis, conns: make(chan net.Conn), done: make(chan struct{})}
+	go func() {
+		defer close(l.done)
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				l.err = err
+				return
+			}
+			go func() {
+				sconn, err := e2eHandshake(conn, name, secret, false)
+				if err != nil {
+					log.Warnf("private tunnel %s: %v", name, err)
+					conn.Close()
+					return
+				}
+				select {
+				case l.conns <- sconn:
+				case <-l.done:
+					sconn.Close()
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func (l *e2eListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// Visit expose private tunnel name on lis, connections are end to end encrypted with secret
+func (c *Client) Visit(name, secret string, lis net.Listener) error {
+	if err := checkSecret(secret); err != nil {
+		return err
+	}
+	wsURL := *c.sURL
+	wsURL.Path = "/ws/visit"
+	wsURL.RawQuery = url.Values{"name": []string{name}}.Encode()
+	for {
+		lconn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			rconn, err := dialReverseConn(wsURL.String(), nil, c.tlsConfig)
+			if err != nil {
+				log.Warnf("visit %s: %v", name, err)
+				lconn.Close()
+				return
+			}
+			sconn, err := e2eHandshake(rconn, name, secret, true)
+			if err != nil {
+				log.Warnf("visit %s: %v", name, err)
+				rconn.Close()
+				lconn.Close()
+				return
+			}
+			pc := &proxyConn{
+				lconn: lconn,
+				rconn: sconn,
+				stats: proxyStats,
+			}
+			pc.start()
+		}()
+	}
+}
+
+// joinPrivateGroup register a tcp tunnel only reachable by visitor clients
+func (ps *ProxyServer) joinPrivateGroup(tunnel *webSocketTunnel, reqInfo RequestInfo) (*tunnelGroup, error) {
+	ps.Lock()
+	defer ps.Unlock()
+	if group, exists := ps.privateGroups[reqInfo.Private]; exists {
+		if !group.join(tunnel, reqInfo.Protocol, reqInfo.Group) {
+			return nil, fmt.Errorf("private tunnel %s has already been taken", reqInfo.Private)
+		}
+		return group, nil
+	}
+	group := newTunnelGroup(reqInfo.Protocol, reqInfo.Group, reqInfo.LB)
+	group.join(tunnel, reqInfo.Protocol, reqInfo.Group)
+	ps.privateGroups[reqInfo.Private] = group
+	return group, nil
+}
+
+func (ps *ProxyServer) leavePrivateGroup(name string, group *tunnelGroup, tunnel *webSocketTunnel) {
+	ps.Lock()
+	defer ps.Unlock()
+	if group.leave(tunnel) {
+		delete(ps.privateGroups, name)
+	}
+}
+
+// visitHandler pipe a visitor client to the private tunnel, only ciphertext pass through
+func (ps *ProxyServer) visitHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	ps.RLock()
+	group := ps.privateGroups[name]
+	ps.RUnlock()
+	if group == nil {
+		http.Error(w, ErrPrivateTunnel.Error(), http.StatusNotFound)
+		return
+	}
+	wsConn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	vconn := wsConn.NetConn()
+	lconn, err := group.RequestNewConn(r.RemoteAddr)
+	if err != nil {
+		log.Warnf("visit %s: %v", name, err)
+		vconn.Close()
+		return
+	}
+	log.Infof("visitor %s connected to private tunnel %s", r.RemoteAddr, name)
+	pc := &proxyConn{
+		lconn: lconn,
+		rconn: vconn,
+		stats: proxyStats,
+	}
+	pc.start()
+}
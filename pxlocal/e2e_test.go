@@ -0,0 +1,146 @@
+package pxlocal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// relayPair connect two conns through a relay which records every byte
+func relayPair(record *bytes.Buffer, mu *sync.Mutex) (visitor, provider net.Conn) {
+	visitor, relayV := net.Pipe()
+	provider, relayP := net.Pipe()
+	copyRecord := func(dst, src net.Conn) {
+		buf := make([]byte, 4096)
+		for {
+			n, err := src.Read(buf)
+			if err != nil {
+				dst.Close()
+				return
+			}
+			mu.Lock()
+			record.Write(buf[:n])
+			mu.Unlock()
+			dst.Write(buf[:n])
+		}
+	}
+	go copyRecord(relayP, relayV)
+	go copyRecord(relayV, relayP)
+	return visitor, provider
+}
+
+func handshakePair(t *testing.T, visitor, provider net.Conn, visitorSecret string) (*secureConn, *secureConn, error) {
+	type result struct {
+		sc  *secureConn
+		err error
+	}
+	resC := make(chan result, 1)
+	go func() {
+		sc, err := e2eHandshake(provider, "db", "s3cret", false)
+		if err != nil {
+			provider.Close()
+		}
+		resC <- result{sc, err}
+	}()
+	vc, err := e2eHandshake(visitor, "db", visitorSecret, true)
+	if err != nil {
+		visitor.Close()
+	}
+	res := <-resC
+	if err == nil {
+		err = res.err
+	}
+	return vc, res.sc, err
+}
+
+func TestE2EHandshake(t *testing.T) {
+	var record bytes.Buffer
+	var mu sync.Mutex
+	visitor, provider := relayPair(&record, &mu)
+	vc, pc, err := handshakePair(t, visitor, provider, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := bytes.Repeat([]byte("top secret data "), 2048) // several records
+	go vc.Write(plain)
+	got := make([]byte, len(plain))
+	if _, err := io.ReadFull(pc, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatal("data changed through secure conn")
+	}
+	go pc.Write([]byte("reply"))
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(vc, reply); err != nil || string(reply) != "reply" {
+		t.Fatalf("unexpected reply %q, err %v", reply, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if bytes.Contains(record.Bytes(), []byte("secret")) || bytes.Contains(record.Bytes(), []byte("reply")) {
+		t.Error("relay sees plaintext")
+	}
+
+	visitor, provider = relayPair(&bytes.Buffer{}, &sync.Mutex{})
+	if _, _, err := handshakePair(t, visitor, provider, "wrong"); !errors.Is(err, ErrE2EHandshake) {
+		t.Errorf("expect handshake failed with wrong secret, but got %v", err)
+	}
+}
+
+func TestE2ECloseRecord(t *testing.T) {
+	visitor, provider := relayPair(&bytes.Buffer{}, &sync.Mutex{})
+	vc, pc, err := handshakePair(t, visitor, provider, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		vc.Write([]byte("bye"))
+		vc.CloseWrite()
+	}()
+	got, err := io.ReadAll(pc)
+	if err != nil || string(got) != "bye" {
+		t.Errorf("expect data then clean EOF, but got %q, err %v", got, err)
+	}
+	if _, err := vc.Write([]byte("more")); err == nil {
+		t.Error("expect write after CloseWrite failed")
+	}
+
+	// the relay cuts the stream, no close record
+	visitor, provider = relayPair(&bytes.Buffer{}, &sync.Mutex{})
+	vc, pc, err = handshakePair(t, visitor, provider, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		vc.Write([]byte("partial"))
+		visitor.Close()
+	}()
+	if got, err := io.ReadAll(pc); !errors.Is(err, ErrE2ETruncated) {
+		t.Errorf("expect truncation detected, but got %q, err %v", got, err)
+	}
+
+	// cut in the middle of a length header
+	visitor, provider = relayPair(&bytes.Buffer{}, &sync.Mutex{})
+	_, pc, err = handshakePair(t, visitor, provider, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		visitor.Write([]byte{0})
+		visitor.Close()
+	}()
+	if got, err := io.ReadAll(pc); !errors.Is(err, ErrE2ETruncated) {
+		t.Errorf("expect truncated header detected, but got %q, err %v", got, err)
+	}
+}
+
+func TestCheckSecret(t *testing.T) {
+	for secret, expect := range map[string]error{"": ErrSecretRequired, "s3cret": ErrSecretWeak, GenerateSecret(): nil} {
+		if err := checkSecret(secret); err != expect {
+			t.Errorf("secret %q: expect %v, but got %v", secret, expect, err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package pxlocal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	texttemplate "text/template"
+)
+
+const (
+	ERROR_PAGE_NOT_FOUND     = "notfound"     // unknown subdomain
+	ERROR_PAGE_OFFLINE       = "offline"      // tunnel client is gone
+	ERROR_PAGE_REFUSED       = "refused"      // local service refused the connection
+	ERROR_PAGE_TIMEOUT       = "timeout"      // client did not make reverse connection in time
+	ERROR_PAGE_UNAVAILABLE   = "unavailable"  // health check of local service failed
+	ERROR_PAGE_LOCAL_TIMEOUT = "localtimeout" // local service did not respond in time
+	ERROR_PAGE_BAD_GATEWAY   = "badgateway"   // other errors of local service, ex: tls or dns
+
+	// set by client when local service can not be reached
+	headerProxylocalError = "X-Proxylocal-Error"
+	maxMaintenancePage    = 256 << 10
+)
+
+var errorPageInfos = map[string]struct {
+	status  int
+	title   string
+	message string
+}{
+	ERROR_PAGE_NOT_FOUND:     {http.StatusNotFound, "Tunnel not found", "There is no tunnel running on this address."},
+	ERROR_PAGE_OFFLINE:       {http.StatusServiceUnavailable, "Tunnel offline", "The tunnel client is not connected right now."},
+	ERROR_PAGE_REFUSED:       {http.StatusBadGateway, "Local service unavailable", "The tunnel is online, but the local service refused the connection."},
+	ERROR_PAGE_TIMEOUT:       {http.StatusGatewayTimeout, "Tunnel timeout", "The tunnel client did not respond in time."},
+	ERROR_PAGE_UNAVAILABLE:   {http.StatusServiceUnavailable, "Service unavailable", "The local service behind this tunnel is not healthy right now."},
+	ERROR_PAGE_LOCAL_TIMEOUT: {http.StatusGatewayTimeout, "Local service timeout", "The tunnel is online, but the local service did not respond in time."},
+	ERROR_PAGE_BAD_GATEWAY:   {http.StatusBadGateway, "Bad gateway", "The tunnel is online, but the request to the local service failed."},
+}
+
+var defaultErrorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Status}} {{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+{{if .Host}}<p><code>{{.Host}}</code></p>{{end}}
+<hr><small>proxylocal</small>
+</body>
+</html>
+`))
+
+type errorPageData struct {
+	Kind    string `json:"kind"`
+	Status  int    `json:"status"`
+	Title   string `json:"title"`
+	Message string `json:"message"`
+	Host    string `json:"host"`
+	Domain  string `json:"domain"`
+	Error   string `json:"error,omitempty"`
+}
+
+// localServiceError is reported by tunnel client in X-Proxylocal-Error header
+type localServiceError struct {
+	kind string
+}
+
+func (e *localServiceError) Error() string {
+	return "local service error: " + e.kind
+}
+
+// localErrorKind map error of requesting local service to an error page
+func localErrorKind(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ERROR_PAGE_LOCAL_TIMEOUT
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, ErrNoBackend):
+		return ERROR_PAGE_REFUSED
+	default:
+		return ERROR_PAGE_BAD_GATEWAY
+	}
+}
+
+// ErrorPages are templates rendered when a tunnel can not serve the request.
+// Templates named <kind>.html and <kind>.json, kind is one of notfound, offline, refused, timeout, unavailable, localtimeout and badgateway.
+type ErrorPages struct {
+	html map[string]*template.Template
+	json map[string]*texttemplate.Template
+}
+
+// LoadErrorPages load templates from dir, missing ones fallback to builtin page
+func LoadErrorPages(dir string) (*ErrorPages, error) {
+	ep := &ErrorPages{
+		html: make(map[string]*template.Template),
+		json: make(map[string]*texttemplate.Template),
+	}
+	for kind := range errorPageInfos {
+		htmlPath := filepath.Join(dir, kind+".html")
+		if _, err := os.Stat(htmlPath); err == nil {
+			t, err := template.ParseFiles(htmlPath)
+			if err != nil {
+				return nil, err
+			}
+			ep.html[kind] = t
+		}
+		jsonPath := filepath.Join(dir, kind+".json")
+		if _, err := os.Stat(jsonPath); err == nil {
+			t, err := texttemplate.ParseFiles(jsonPath)
+			if err != nil {
+				return nil, err
+			}
+			ep.json[kind] = t
+		}
+	}
+	return ep, nil
+}
+
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// render write error page, maintenance page from the tunnel client is preferred for html
+func (ep *ErrorPages) render(w http.ResponseWriter, r *http.Request, kind string, data errorPageData, maintenance string) {
+	info := errorPageInfos[kind]
+	data.Kind, data.Status = kind, info.status
+	data.Title, data.Message = info.title, info.message
+	if data.Host == "" {
+		data.Host = r.Host
+	}
+
+	buf := bytes.NewBuffer(nil)
+	var contentType string
+	if wantsJSON(r) {
+		contentType = "application/json"
+		if t := ep.jsonTemplate(kind); t != nil {
+			if err := t.Execute(buf, data); err != nil {
+				buf.Reset()
+			}
+		}
+		if buf.Len() == 0 {
+			json.NewEncoder(buf).Encode(data)
+		}
+	} else {
+		contentType = "text/html; charset=utf-8"
+		if maintenance != "" && kind != ERROR_PAGE_NOT_FOUND {
+			buf.WriteString(maintenance)
+		} else if err := ep.htmlTemplate(kind).Execute(buf, data); err != nil {
+			buf.Reset()
+			defaultErrorPage.Execute(buf, data)
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(data.Status)
+	w.Write(buf.Bytes())
+}
+
+func (ep *ErrorPages) htmlTemplate(kind string) *template.Template {
+	if ep != nil && ep.html[kind] != nil {
+		return ep.html[kind]
+	}
+	return defaultErrorPage
+}
+
+func (ep *ErrorPages) jsonTemplate(kind string) *texttemplate.Template {
+	if ep == nil {
+		return nil
+	}
+	return ep.json[kind]
+}
@@ -0,0 +1,119 @@
+package pxlocal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	HOST_HEADER_PRESERVE = "preserve" // keep the public host, good for vhost based apps
+	HOST_HEADER_REWRITE  = "rewrite"  // use the local address
+)
+
+var ErrHostHeader = errors.New("host header should be preserve, rewrite or a host like example.com")
+
+var forwardedHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+}
+
+// ParseTrustedProxies parse ips or cidrs of proxies in front of server
+func ParseTrustedProxies(values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %s: %v", v, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// fromTrustedProxy is true when the peer of request is one of nets
+func fromTrustedProxy(r *http.Request, nets []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, n := range nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setForwarded add RFC 7239 Forwarded header, X-Forwarded-* should already be set,
+// the element is appended to the header of a trusted proxy
+func setForwarded(out *http.Request, in *http.Request, trusted bool) {
+	var parts []string
+	if host, _, err := net.SplitHostPort(in.RemoteAddr); err == nil {
+		if strings.Contains(host, ":") { // ipv6 must be quoted
+			host = `"[` + host + `]"`
+		}
+		parts = append(parts, "for="+host)
+	}
+	if in.Host != "" {
+		parts = append(parts, `host="`+in.Host+`"`)
+	}
+	if proto := out.Header.Get("X-Forwarded-Proto"); proto != "" {
+		parts = append(parts, "proto="+proto)
+	}
+	elem := strings.Join(parts, ";")
+	if prior := in.Header.Values("Forwarded"); trusted && len(prior) > 0 {
+		elem = strings.Join(prior, ", ") + ", " + elem
+	}
+	out.Header.Set("Forwarded", elem)
+}
+
+// copyForwardedHeaders keep forwarding headers set by proxylocal server
+func copyForwardedHeaders(dst, src http.Header) {
+	for _, key := range forwardedHeaders {
+		if values, ok := src[key]; ok {
+			dst[key] = values
+		}
+	}
+}
+
+// checkHostHeader catch typos of modes, a custom host looks like example.com or localhost:8080
+func checkHostHeader(mode string) error {
+	switch mode {
+	case "", HOST_HEADER_REWRITE, HOST_HEADER_PRESERVE:
+		return nil
+	}
+	host := mode
+	if h, _, err := net.SplitHostPort(mode); err == nil {
+		host = h
+	}
+	if strings.ContainsAny(mode, " /\\@?#") || host == "" ||
+		(!strings.Contains(mode, ".") && !strings.Contains(mode, ":") && host != "localhost") {
+		return fmt.Errorf("%w: %q", ErrHostHeader, mode)
+	}
+	return nil
+}
+
+// hostHeader choose Host header send to local service
+func hostHeader(mode string, publicHost string, localHost string) string {
+	switch mode {
+	case "", HOST_HEADER_REWRITE:
+		return localHost
+	case HOST_HEADER_PRESERVE:
+		return publicHost
+	default:
+		return mode
+	}
+}
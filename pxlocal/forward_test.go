@@ -0,0 +1,58 @@
+package pxlocal
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestSetForwarded(t *testing.T) {
+	in, _ := http.NewRequest("GET", "http://app.pxl.test/", nil)
+	in.RemoteAddr = "10.0.0.2:4000"
+	in.Header.Set("Forwarded", "for=203.0.113.1;proto=https")
+	out := in.Clone(in.Context())
+	out.Header = http.Header{"X-Forwarded-Proto": {"http"}}
+
+	setForwarded(out, in, false)
+	if got := out.Header.Get("Forwarded"); got != `for=10.0.0.2;host="app.pxl.test";proto=http` {
+		t.Errorf("expect forwarded of visitor replaced, but got %q", got)
+	}
+	setForwarded(out, in, true)
+	if got := out.Header.Get("Forwarded"); got != `for=203.0.113.1;proto=https, for=10.0.0.2;host="app.pxl.test";proto=http` {
+		t.Errorf("expect forwarded of trusted proxy appended, but got %q", got)
+	}
+}
+
+func TestFromTrustedProxy(t *testing.T) {
+	nets, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, expect := range map[string]bool{
+		"10.1.2.3:80":    true,
+		"192.0.2.1:80":   true,
+		"192.0.2.2:80":   false,
+		"[::1]:80":       true,
+		"203.0.113.1:80": false,
+	} {
+		if got := fromTrustedProxy(&http.Request{RemoteAddr: addr}, nets); got != expect {
+			t.Errorf("%s: expect trusted %v, but got %v", addr, expect, got)
+		}
+	}
+	if _, err := ParseTrustedProxies([]string{"10.0.0.300"}); err == nil {
+		t.Error("expect invalid ip rejected")
+	}
+}
+
+func TestCheckHostHeader(t *testing.T) {
+	for _, mode := range []string{"", "preserve", "rewrite", "app.example.com", "localhost", "localhost:8080", "127.0.0.1:3000"} {
+		if err := checkHostHeader(mode); err != nil {
+			t.Errorf("%q: unexpected %v", mode, err)
+		}
+	}
+	for _, mode := range []string{"presrve", "Rewrite", "a b.com", "example.com/path", ":8080"} {
+		if err := checkHostHeader(mode); !errors.Is(err, ErrHostHeader) {
+			t.Errorf("%q: expect rejected, but got %v", mode, err)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package pxlocal
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gobuild/log"
+)
+
+const (
+	LB_ROUND_ROBIN = "round-robin"
+	LB_LEAST_CONN  = "least-conn"
+)
+
+var ErrNoTunnelMember = errors.New("no tunnel member available")
+
+// tunnelGroup is a pool of tunnels sharing one subdomain or tcp port.
+// Clients join the same group with the same group key.
+type tunnelGroup struct {
+	protocol string
+	keyHash  []byte // nil means the group can not be joined
+	strategy string
+	guard    *shareGuard      // http only
+	handler  http.Handler     // http only
+	aliases  []*route         // wildcard and custom hostnames, http only
+	host     string           // subdomain claimed by the group, http only
+	listener *net.TCPListener // tcp and port tunnel
+	server   *http.Server     // port tunnel only, closed with its keep-alive connections
+	sync.Mutex
+	members    []*webSocketTunnel
+	transports map[*webSocketTunnel]*http.Transport // keep-alive pool of each member
+	next       int
+}
+
+func newTunnelGroup(protocol, key, strategy string) *tunnelGroup {
+	g := &tunnelGroup{
+		protocol:   protocol,
+		strategy:   strategy,
+		transports: make(map[*webSocketTunnel]*http.Transport),
+	}
+	if key != "" {
+		sum := sha256.Sum256([]byte(key))
+		g.keyHash = sum[:]
+	}
+	return g
+}
+
+// sameKey is true when key is the group key, a group without key never matches
+func (g *tunnelGroup) sameKey(key string) bool {
+	sum := sha256.Sum256([]byte(key))
+	return g.keyHash != nil && key != "" && subtle.ConstantTimeCompare(sum[:], g.keyHash) == 1
+}
+
+// join add tunnel to group, return false when group key or protocol not match
+func (g *tunnelGroup) join(t *webSocketTunnel, protocol, key string) bool {
+	g.Lock()
+	defer g.Unlock()
+	if len(g.members) > 0 && (protocol != g.protocol || !g.sameKey(key)) {
+		return false
+	}
+	g.members = append(g.members, t)
+	tr := &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			log.Println("transport", network, addr)
+			return t.RequestNewConn(nextConnName())
+		},
+	}
+	if g.protocol == "http2" {
+		tr.Protocols = h2cProtocols() // carry http/2 frames through the tunnel
+	}
+	g.transports[t] = tr
+	return true
+}
+
+// leave remove tunnel from group, return true when group become empty
+func (g *tunnelGroup) leave(t *webSocketTunnel) bool {
+	g.Lock()
+	defer g.Unlock()
+	for i, m := range g.members {
+		if m == t {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			g.transports[t].CloseIdleConnections()
+			delete(g.transports, t)
+			break
+		}
+	}
+	return len(g.members) == 0
+}
+
+func (g *tunnelGroup) hasAlias(key string) bool {
+	for _, alias := range g.aliases {
+		if alias.key() == key {
+			return true
+		}
+	}
+	return false
+}
+
+// pick choose a member, unhealthy members are skipped unless all are unhealthy
+func (g *tunnelGroup) pick() (*webSocketTunnel, error) {
+	g.Lock()
+	defer g.Unlock()
+	candidates := make([]*webSocketTunnel, 0, len(g.members))
+	for _, m := range g.members {
+		if !m.unhealthy.Load() {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = g.members
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoTunnelMember
+	}
+	if g.strategy == LB_LEAST_CONN {
+		best := candidates[0]
+		for _, m := range candidates[1:] {
+			if m.active.Load() < best.active.Load() {
+				best = m
+			}
+		}
+		return best, nil
+	}
+	g.next = (g.next + 1) % len(candidates)
+	return candidates[g.next], nil
+}
+
+// healthy is true when any member is healthy
+func (g *tunnelGroup) healthy() bool {
+	g.Lock()
+	defer g.Unlock()
+	for _, m := range g.members {
+		if !m.unhealthy.Load() {
+			return true
+		}
+	}
+	return len(g.members) == 0
+}
+
+func (g *tunnelGroup) maintenancePage() string {
+	g.Lock()
+	defer g.Unlock()
+	for _, m := range g.members {
+		if page := m.maintenancePage(); page != "" {
+			return page
+		}
+	}
+	return ""
+}
+
+// memberConn count active connections of a member, used by least-conn
+type memberConn struct {
+	net.Conn
+	once   sync.Once
+	active *atomic.Int64
+}
+
+func (c *memberConn) Close() error {
+	c.once.Do(func() { c.active.Add(-1) })
+	return c.Conn.Close()
+}
+
+func (c *memberConn) CloseRead() error  { return closeRead(c.Conn) }
+func (c *memberConn) CloseWrite() error { return closeWrite(c.Conn) }
+
+func (g *tunnelGroup) RequestNewConn(remoteAddr string) (net.Conn, error) {
+	t, err := g.pick()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.RequestNewConn(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	t.active.Add(1)
+	return &memberConn{Conn: conn, active: &t.active}, nil
+}
+
+// RoundTrip send request to a member, members are picked per request,
+// while connections to the same member are reused
+func (g *tunnelGroup) RoundTrip(req *http.Request) (*http.Response, error) {
+	t, err := g.pick()
+	if err != nil {
+		return nil, err
+	}
+	g.Lock()
+	tr := g.transports[t]
+	g.Unlock()
+	if tr == nil {
+		return nil, ErrNoTunnelMember
+	}
+	t.active.Add(1)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.active.Add(-1)
+		return nil, err
+	}
+	body := &memberBody{ReadCloser: resp.Body, active: &t.active}
+	if rwc, ok := resp.Body.(io.ReadWriteCloser); ok {
+		// keep body writable, reverse proxy use it for upgraded connections
+		resp.Body = &memberRWBody{memberBody: body, w: rwc}
+	} else {
+		resp.Body = body
+	}
+	return resp, nil
+}
+
+type memberBody struct {
+	io.ReadCloser
+	once   sync.Once
+	active *atomic.Int64
+}
+
+func (b *memberBody) Close() error {
+	b.once.Do(func() { b.active.Add(-1) })
+	return b.ReadCloser.Close()
+}
+
+type memberRWBody struct {
+	*memberBody
+	w io.Writer
+}
+
+func (b *memberRWBody) Write(p []byte) (int, error) {
+	return b.w.Write(p)
+}
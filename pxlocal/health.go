@@ -0,0 +1,113 @@
+package pxlocal
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gobuild/log"
+)
+
+const (
+	HEALTH_CHECK_TCP  = "tcp"
+	HEALTH_CHECK_HTTP = "http"
+
+	healthUp   = "up"
+	healthDown = "down"
+)
+
+// HealthCheck probe local service and report to server,
+// visitors get a service unavailable page when it is down
+type HealthCheck struct {
+	Type        string        // tcp or http, empty means disabled
+	Path        string        // request path of http probe, default /
+	Interval    time.Duration // default 5s
+	Timeout     time.Duration // default 2s
+	WaitHealthy bool          // register tunnel only after local service is healthy
+}
+
+func (hc HealthCheck) withDefaults() HealthCheck {
+	if hc.Path == "" {
+		hc.Path = "/"
+	}
+	if hc.Interval <= 0 {
+		hc.Interval = 5 * time.Second
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = 2 * time.Second
+	}
+	return hc
+}
+
+// probe return nil when local service is healthy
+func (up *upstream) probe(hc HealthCheck) error {
+	if up.network == "file" {
+		return nil
+	}
+	switch hc.Type {
+	case HEALTH_CHECK_HTTP:
+		client := &http.Client{
+			Transport: up.transport(HTTP),
+			Timeout:   hc.Timeout,
+		}
+		defer client.CloseIdleConnections()
+		resp, err := client.Get(up.scheme + "://" + up.host + hc.Path)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("health check status %s", resp.Status)
+		}
+		return nil
+	default:
+		conn, err := up.dialRaw(hc.Timeout)
+		if err != nil {
+			return err
+		}
+		conn.SetDeadline(time.Now().Add(hc.Timeout))
+		conn, err = up.wrap(conn)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// waitHealthy block until local service passes the probe
+func (up *upstreamPool) waitHealthy(hc HealthCheck) {
+	hc = hc.withDefaults()
+	for {
+		err := up.probe(hc)
+		if err == nil {
+			return
+		}
+		log.Infof("waiting for local service: %v", err)
+		time.Sleep(hc.Interval)
+	}
+}
+
+// healthLoop report health of local service to server when it changes
+func (p *ProxyConnector) healthLoop(up *upstreamPool, hc HealthCheck) {
+	hc = hc.withDefaults()
+	last := ""
+	for {
+		state := healthUp
+		if err := up.probe(hc); err != nil {
+			log.Debugf("health check failed: %v", err)
+			state = healthDown
+		}
+		if state != last {
+			log.Infof("local service is %s", state)
+			if err := p.sendMessage(TYPE_HEALTH, state); err != nil {
+				return
+			}
+			last = state
+		}
+		select {
+		case <-p.done:
+			return
+		case <-time.After(hc.Interval):
+		}
+	}
+}
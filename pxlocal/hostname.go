@@ -0,0 +1,113 @@
+package pxlocal
+
+import (
+	"crypto/ed25519"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gobuild/log"
+)
+
+// Custom hostnames are verified by DNS TXT instead of an HTTP challenge through the tunnel.
+// A hostname CNAME'd to the server routes here for every client, so answering a challenge
+// sent to it proves nothing about which client owns it, and fetching it makes the server
+// request any address a client names. The TXT record binds the hostname to one identity key.
+
+// challengeLabel is prefixed to a custom hostname, the TXT record there names the key allowed to claim it
+const challengeLabel = "_proxylocal-challenge."
+
+var ErrHostnameVerify = errors.New("hostname verification failed")
+
+// names only resolved in private networks, a tunnel can not claim them
+var privateSuffixes = []string{"localhost", "localdomain", "local", "internal", "intranet", "lan", "home", "corp", "private", "arpa", "test", "invalid"}
+
+// hostnameToken is the TXT record value binding a hostname to the identity key of client
+func hostnameToken(pub ed25519.PublicKey) string {
+	return "proxylocal-key=" + encodePublicKey(pub)
+}
+
+// checkPublicHostname reject ip literals, loopback and private names
+func checkPublicHostname(hostname string) error {
+	if net.ParseIP(hostname) != nil {
+		return fmt.Errorf("%w: %s is an ip address", ErrHostnameVerify, hostname)
+	}
+	labels := strings.Split(hostname, ".")
+	if len(labels) < 2 {
+		return fmt.Errorf("%w: %s is not a public hostname", ErrHostnameVerify, hostname)
+	}
+	for _, label := range labels {
+		if !labelRe.MatchString(label) {
+			return fmt.Errorf("%w: %s is not a valid hostname", ErrHostnameVerify, hostname)
+		}
+	}
+	for _, suffix := range privateSuffixes {
+		if hostname == suffix || strings.HasSuffix(hostname, "."+suffix) {
+			return fmt.Errorf("%w: %s is a private name", ErrHostnameVerify, hostname)
+		}
+	}
+	return nil
+}
+
+// verifyHostname look up the TXT record of hostname, only dns is queried, nothing is fetched from the host
+func (ps *ProxyServer) verifyHostname(hostname string, pub ed25519.PublicKey) error {
+	lookupTXT := ps.lookupTXT
+	if lookupTXT == nil {
+		lookupTXT = net.LookupTXT
+	}
+	token := hostnameToken(pub)
+	records, _ := lookupTXT(challengeLabel + hostname)
+	for _, record := range records {
+		if subtle.ConstantTimeCompare([]byte(record), []byte(token)) == 1 {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: add TXT record %s%s with value %q", ErrHostnameVerify, challengeLabel, hostname, token)
+}
+
+// customHostnames verify hostnames requested by client, the ones failed are reported to client.
+// The hostname must have a TXT record naming the identity key of client.
+func (ps *ProxyServer) customHostnames(hostnames []string, pub ed25519.PublicKey, tunnel *webSocketTunnel) (verified []string) {
+	if pub == nil {
+		tunnel.sendMessage(TYPE_MESSAGE, "custom hostnames need an identity key (--identity)")
+		return nil
+	}
+	for _, hostname := range hostnames {
+		hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+		if d := ps.baseDomainOf(hostname); d != nil {
+			tunnel.sendMessage(TYPE_MESSAGE, fmt.Sprintf("hostname [%s] is under %s, use subdomain instead", hostname, d.Name))
+			continue
+		}
+		err := checkPublicHostname(hostname)
+		if err == nil {
+			err = ps.verifyHostname(hostname, pub)
+		}
+		if err != nil {
+			log.Warnf("verify hostname %s: %v", hostname, err)
+			tunnel.sendMessage(TYPE_MESSAGE, err.Error())
+			continue
+		}
+		verified = append(verified, hostname)
+	}
+	return verified
+}
+
+// addAliases route more hosts to the group of rt, they are removed when group become empty
+func (ps *ProxyServer) addAliases(rt *route, group *tunnelGroup, hosts []string, tunnel *webSocketTunnel) {
+	ps.Lock()
+	defer ps.Unlock()
+	for _, host := range hosts {
+		alias := &route{host: host, prefix: rt.prefix, strip: rt.strip, handler: group.handler}
+		if group.hasAlias(alias.key()) {
+			continue
+		}
+		if !ps.routes.add(alias) {
+			tunnel.sendMessage(TYPE_MESSAGE, fmt.Sprintf("hostname [%s] has already been taken", alias.key()))
+			continue
+		}
+		group.aliases = append(group.aliases, alias)
+		tunnel.sendMessage(TYPE_MESSAGE, fmt.Sprintf("%s is also routed to this tunnel", alias.key()))
+	}
+}
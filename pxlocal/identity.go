@@ -0,0 +1,151 @@
+package pxlocal
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	ErrIdentityVerify      = errors.New("identity key verification failed")
+	ErrIdentityUnsupported = errors.New("server does not support identity keys")
+)
+
+// signed by client, the prefix keeps the signature from being used elsewhere
+const challengeContext = "proxylocal-challenge:"
+
+var keyNameEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// LoadOrCreateIdentityKey read ed25519 private key in PKCS8 or OpenSSH PEM, ex: ~/.ssh/id_ed25519,
+// a new one is created when file not exists
+func LoadOrCreateIdentityKey(filename string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		return key, os.WriteFile(filename, data, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", filename)
+	}
+	if block.Type == "OPENSSH PRIVATE KEY" {
+		key, err := parseOpenSSHPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", filename)
+	}
+	return key, nil
+}
+
+func encodePublicKey(pub ed25519.PublicKey) string {
+	return base64.RawURLEncoding.EncodeToString(pub)
+}
+
+func decodePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: invalid public key", ErrIdentityVerify)
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+var keySubdomainRe = regexp.MustCompile(`^k[a-z2-7]{15}$`)
+
+func isKeySubdomain(name string) bool {
+	return keySubdomainRe.MatchString(name)
+}
+
+// keySubdomain derive a stable subdomain from public key
+func keySubdomain(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return "k" + strings.ToLower(keyNameEncoding.EncodeToString(sum[:]))[:15]
+}
+
+// challengeMessage bind the nonce to the server host, so a signature asked by
+// another server can not be relayed here
+func challengeMessage(host, nonce string) []byte {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return []byte(challengeContext + host + ":" + nonce)
+}
+
+func signChallenge(key ed25519.PrivateKey, host, nonce string) string {
+	return base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, challengeMessage(host, nonce)))
+}
+
+// answerChallenge is called by client right after the control connection to host is made
+func answerChallenge(conn *websocket.Conn, key ed25519.PrivateKey, host string) error {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	var msg message
+	if err := conn.ReadJSON(&msg); err != nil {
+		return err
+	}
+	switch msg.Type {
+	case TYPE_CHALLENGE:
+	case TYPE_MESSAGE: // rejected by server
+		return fmt.Errorf("%w: %s", ErrIdentityVerify, msg.Body)
+	default: // old server registered the tunnel without asking
+		return ErrIdentityUnsupported
+	}
+	return conn.WriteJSON(&message{Type: TYPE_CHALLENGE, Body: signChallenge(key, host, msg.Body)})
+}
+
+// verifyIdentity ask client to sign a nonce with the private key of pub,
+// host is the server host client connected to
+func (t *webSocketTunnel) verifyIdentity(pub ed25519.PublicKey, host string) error {
+	nonce := randomToken()
+	if err := t.sendMessage(TYPE_CHALLENGE, nonce); err != nil {
+		return err
+	}
+	t.wsconn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer t.wsconn.SetReadDeadline(time.Time{})
+	var msg message
+	if err := t.wsconn.ReadJSON(&msg); err != nil {
+		return err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(msg.Body)
+	if msg.Type != TYPE_CHALLENGE || err != nil || !ed25519.Verify(pub, challengeMessage(host, nonce), sig) {
+		return ErrIdentityVerify
+	}
+	return nil
+}
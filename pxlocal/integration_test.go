@@ -0,0 +1,1331 @@
+package pxlocal
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const testDomain = "pxl.test"
+
+const testSecret = "s3cret-of-the-db-tunnel"
+
+var testHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// testTunnel is a proxylocal server and a connected client
+type testTunnel struct {
+	server *httptest.Server
+	ps     *ProxyServer
+	host   string // public host of http tunnel
+}
+
+func startTestTunnel(t *testing.T, opts ProxyOptions) *testTunnel {
+	ps := NewProxyServer(testDomain)
+	server := httptest.NewUnstartedServer(ps)
+	server.Config.Protocols = ServerProtocols()
+	server.Start()
+	t.Cleanup(server.Close)
+
+	px, err := NewClient(server.URL).RunProxy(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { px.Close() })
+
+	tt := &testTunnel{server: server, ps: ps, host: opts.Subdomain + "." + testDomain}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if ps.routes.match(tt.host, cleanPrefix(opts.PathPrefix)) != nil {
+			return tt
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("tunnel %s not registered", tt.host)
+	return nil
+}
+
+func (tt *testTunnel) get(t *testing.T, path string, header http.Header) *http.Response {
+	req, _ := http.NewRequest("GET", tt.server.URL+path, nil)
+	req.Host = tt.host
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := testHTTPClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func newTestBackend(t *testing.T) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/headers", func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Host", r.Host)
+		json.NewEncoder(w).Encode(r.Header)
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			mt, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(mt, append([]byte("echo:"), data...))
+		}
+	})
+	mux.HandleFunc("/sse", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 2; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			// events only reach visitor in time when every hop flushes
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(2 * time.Second):
+			}
+		}
+	})
+	backend := httptest.NewServer(mux)
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestHTTPTunnelForwardedHeaders(t *testing.T) {
+	backend := newTestBackend(t)
+	tt := startTestTunnel(t, ProxyOptions{
+		Proto:      HTTP,
+		Subdomain:  "headers",
+		LocalAddr:  backend.Listener.Addr().String(),
+		HostHeader: HOST_HEADER_PRESERVE,
+	})
+	resp := tt.get(t, "/headers", http.Header{"X-Forwarded-For": {"6.6.6.6"}})
+	defer resp.Body.Close()
+	var header http.Header
+	if err := json.NewDecoder(resp.Body).Decode(&header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("Host") != tt.host {
+		t.Errorf("expect host %s, but got %s", tt.host, header.Get("Host"))
+	}
+	if header.Get("X-Forwarded-For") != "127.0.0.1" {
+		t.Errorf("expect X-Forwarded-For 127.0.0.1, but got %v", header["X-Forwarded-For"])
+	}
+	if header.Get("X-Forwarded-Host") != tt.host || header.Get("X-Forwarded-Proto") != "http" {
+		t.Errorf("unexpected forwarded headers %v", header)
+	}
+
+	// a proxy in front keeps its chain
+	tt.ps.TrustedProxies, _ = ParseTrustedProxies([]string{"127.0.0.1"})
+	resp = tt.get(t, "/headers", http.Header{"X-Forwarded-For": {"6.6.6.6"}, "Forwarded": {"for=6.6.6.6"}})
+	defer resp.Body.Close()
+	header = nil
+	if err := json.NewDecoder(resp.Body).Decode(&header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("X-Forwarded-For") != "6.6.6.6, 127.0.0.1" || !strings.HasPrefix(header.Get("Forwarded"), "for=6.6.6.6, for=127.0.0.1;") {
+		t.Errorf("expect chain of trusted proxy appended, but got %v", header)
+	}
+}
+
+func TestHTTPTunnelLocalErrorPages(t *testing.T) {
+	lis, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddr := lis.Addr().String()
+	lis.Close()
+	tt := startTestTunnel(t, ProxyOptions{Proto: HTTP, Subdomain: "down", LocalAddr: closedAddr})
+	resp := tt.get(t, "/", http.Header{"Accept": {"application/json"}})
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || !strings.Contains(string(body), `"kind":"refused"`) {
+		t.Errorf("expect refused page, but got %s %s", resp.Status, body)
+	}
+
+	// local service can not fake error pages
+	forged := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerProxylocalError, ERROR_PAGE_REFUSED)
+		io.WriteString(w, "app")
+	}))
+	t.Cleanup(forged.Close)
+	tt = startTestTunnel(t, ProxyOptions{Proto: HTTP, Subdomain: "forged", LocalAddr: forged.Listener.Addr().String()})
+	resp = tt.get(t, "/", nil)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "app" || resp.Header.Get(headerProxylocalError) != "" {
+		t.Errorf("expect response of local service, but got %s %s %v", resp.Status, body, resp.Header)
+	}
+
+	for err, kind := range map[error]string{
+		context.DeadlineExceeded:             ERROR_PAGE_LOCAL_TIMEOUT,
+		&net.DNSError{Err: "no such host"}:   ERROR_PAGE_BAD_GATEWAY,
+		&net.DNSError{IsTimeout: true}:       ERROR_PAGE_LOCAL_TIMEOUT,
+		errors.New("tls: handshake failure"): ERROR_PAGE_BAD_GATEWAY,
+		fmt.Errorf("wrap: %w", ErrNoBackend): ERROR_PAGE_REFUSED,
+	} {
+		if got := localErrorKind(err); got != kind {
+			t.Errorf("expect %v mapped to %s, but got %s", err, kind, got)
+		}
+	}
+}
+
+func TestHTTPTunnelNewShareLink(t *testing.T) {
+	backend := newTestBackend(t)
+	ps := NewProxyServer(testDomain)
+	server := httptest.NewServer(ps)
+	t.Cleanup(server.Close)
+
+	connect := func(opts ProxyOptions) *ProxyConnector {
+		opts.Proto, opts.LocalAddr = HTTP, backend.Listener.Addr().String()
+		px, err := NewClient(server.URL).RunProxy(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { px.Close() })
+		if _, err := px.WaitRemoteAddr(2 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+		return px
+	}
+	px := connect(ProxyOptions{Subdomain: "shared", ShareOnce: true})
+	link, err := px.NewShareLink(time.Hour, true)
+	if err != nil || !strings.Contains(link, "shared."+testDomain+"/?"+shareTokenParam+"=") {
+		t.Fatalf("unexpected share link %q, err %v", link, err)
+	}
+	u, _ := url.Parse(link)
+	req, _ := http.NewRequest("GET", server.URL+"/"+"?"+u.RawQuery, nil)
+	req.Host = u.Host
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("expect minted link redeemed, but got %s", resp.Status)
+	}
+
+	plain := connect(ProxyOptions{Subdomain: "plain"})
+	if _, err := plain.NewShareLink(0, false); !errors.Is(err, ErrShareDisabled) {
+		t.Errorf("expect share disabled, but got %v", err)
+	}
+}
+
+func TestTCPTunnelHalfClose(t *testing.T) {
+	// backend answers only after the visitor finished writing
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := io.ReadAll(conn)
+				io.WriteString(conn, "resp:"+string(data))
+			}()
+		}
+	}()
+	ps := NewProxyServer("127.0.0.1")
+	server := httptest.NewServer(ps)
+	t.Cleanup(server.Close)
+
+	px, err := NewClient(server.URL).RunProxy(ProxyOptions{Proto: TCP, LocalAddr: backend.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { px.Close() })
+	addr, err := px.WaitRemoteAddr(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "hello")
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(conn)
+	if err != nil || string(data) != "resp:hello" {
+		t.Errorf("expect response after half close, but got %q, err %v", data, err)
+	}
+}
+
+func TestHTTPTunnelWebsocket(t *testing.T) {
+	backend := newTestBackend(t)
+	tt := startTestTunnel(t, ProxyOptions{
+		Proto:     HTTP,
+		Subdomain: "websocket",
+		LocalAddr: backend.Listener.Addr().String(),
+	})
+	wsURL := strings.Replace(tt.server.URL, "http://", "ws://", 1) + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Host": {tt.host}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 3; i++ {
+		msg := fmt.Sprintf("hello %d", i)
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "echo:"+msg {
+			t.Fatalf("expect echo:%s, but got %s", msg, data)
+		}
+	}
+}
+
+func TestHTTPTunnelServerSentEvents(t *testing.T) {
+	backend := newTestBackend(t)
+	tt := startTestTunnel(t, ProxyOptions{
+		Proto:     HTTP,
+		Subdomain: "sse",
+		LocalAddr: backend.Listener.Addr().String(),
+	})
+	start := time.Now()
+	resp := tt.get(t, "/sse", nil)
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "data: 0\n" {
+		t.Fatalf("unexpected event %q", line)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("first event is not flushed immediately, took %v", elapsed)
+	}
+	rest, _ := io.ReadAll(reader)
+	if !strings.Contains(string(rest), "data: 1") {
+		t.Fatalf("missing events: %q", rest)
+	}
+}
+
+func TestHTTP2TunnelStreamingWithTrailers(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http.Error(w, "http/2 required", http.StatusHTTPVersionNotSupported)
+			return
+		}
+		// echo every line like a bidirectional streaming rpc
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		reader := bufio.NewReader(r.Body)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			io.WriteString(w, "echo:"+line)
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	backend.Config.Protocols = h2cProtocols()
+	backend.Start()
+	t.Cleanup(backend.Close)
+
+	tt := startTestTunnel(t, ProxyOptions{
+		Proto:     HTTP2,
+		Subdomain: "grpc",
+		LocalAddr: backend.Listener.Addr().String(),
+	})
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest("POST", tt.server.URL+"/echo", pr)
+	req.Host = tt.host
+	client := &http.Client{
+		Transport: &http.Transport{Protocols: h2cProtocols()},
+		Timeout:   10 * time.Second,
+	}
+	go io.WriteString(pw, "ping 0\n")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Fatalf("unexpected response %v %v", resp.Status, resp.Proto)
+	}
+	reader := bufio.NewReader(resp.Body)
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			fmt.Fprintf(pw, "ping %d\n", i)
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != fmt.Sprintf("echo:ping %d\n", i) {
+			t.Fatalf("unexpected line %q", line)
+		}
+	}
+	pw.Close()
+	io.ReadAll(reader)
+	if resp.Trailer.Get("Grpc-Status") != "0" {
+		t.Fatalf("trailer lost: %v", resp.Trailer)
+	}
+}
+
+func TestHTTPTunnelHTTPSUpstream(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secure")
+	}))
+	t.Cleanup(backend.Close)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	pem.Encode(mustCreate(t, caFile), &pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+
+	tt := startTestTunnel(t, ProxyOptions{
+		Proto:       HTTP,
+		Subdomain:   "https",
+		LocalAddr:   backend.URL,
+		UpstreamTLS: UpstreamTLS{CAFile: caFile},
+	})
+	resp := tt.get(t, "/", nil)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "secure" {
+		t.Fatalf("unexpected response %v %q", resp.Status, body)
+	}
+}
+
+func mustCreate(t *testing.T, name string) *os.File {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestHTTPTunnelUnixSocket(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "local.sock")
+	lis, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Skip("unix socket not supported:", err)
+	}
+	go http.Serve(lis, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "host:"+r.Host)
+	}))
+	t.Cleanup(func() { lis.Close() })
+
+	tt := startTestTunnel(t, ProxyOptions{
+		Proto:     HTTP,
+		Subdomain: "unix",
+		LocalAddr: "unix://" + sockPath,
+	})
+	resp := tt.get(t, "/", nil)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "host:localhost" {
+		t.Fatalf("unexpected response %v %q", resp.Status, body)
+	}
+}
+
+func TestHTTPTunnelHealthCheck(t *testing.T) {
+	backend := newTestBackend(t)
+	tt := startTestTunnel(t, ProxyOptions{
+		Proto:       HTTP,
+		Subdomain:   "health",
+		LocalAddr:   backend.Listener.Addr().String(),
+		HealthCheck: HealthCheck{Type: HEALTH_CHECK_TCP, Interval: 50 * time.Millisecond},
+	})
+	resp := tt.get(t, "/headers", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expect 200, but got %v", resp.Status)
+	}
+
+	backend.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		resp = tt.get(t, "/headers", http.Header{"Accept": {"application/json"}})
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			if !strings.Contains(string(body), ERROR_PAGE_UNAVAILABLE) {
+				t.Fatalf("unexpected error page %s", body)
+			}
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("tunnel is not marked as unavailable")
+}
+
+func TestHTTPTunnelGroup(t *testing.T) {
+	newNamedBackend := func(name string) string {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(backend.Close)
+		return backend.Listener.Addr().String()
+	}
+	opts := ProxyOptions{
+		Proto:     HTTP,
+		Subdomain: "group",
+		LocalAddr: newNamedBackend("a"),
+		GroupKey:  "secret",
+	}
+	tt := startTestTunnel(t, opts)
+	opts.LocalAddr = newNamedBackend("b")
+	px, err := NewClient(tt.server.URL).RunProxy(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { px.Close() })
+	if _, err := px.WaitRemoteAddr(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		resp := tt.get(t, "/", nil)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		seen[string(body)]++
+	}
+	if seen["a"] != 2 || seen["b"] != 2 {
+		t.Errorf("expect requests spread to both members, but got %v", seen)
+	}
+
+	// wrong key can not join the group
+	g := newTunnelGroup("http", "secret", LB_ROUND_ROBIN)
+	g.join(&webSocketTunnel{}, "http", "secret")
+	if g.join(&webSocketTunnel{}, "http", "wrong") || g.join(&webSocketTunnel{}, "tcp", "secret") {
+		t.Error("expect join rejected")
+	}
+}
+
+func TestHTTPTunnelLocalBalance(t *testing.T) {
+	var addrs []string
+	for _, name := range []string{"a", "b"} {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(backend.Close)
+		addrs = append(addrs, backend.Listener.Addr().String())
+	}
+	// nothing listen on the closed port, it should be skipped
+	lis, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead := lis.Addr().String()
+	lis.Close()
+	opts := ProxyOptions{
+		Proto:     HTTP,
+		Subdomain: "balance",
+		LocalAddr: strings.Join([]string{addrs[0], dead, addrs[1]}, ","),
+	}
+	tt := startTestTunnel(t, opts)
+
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		resp := tt.get(t, "/", nil)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		seen[string(body)]++
+	}
+	if seen["a"]+seen["b"] != 4 || seen["a"] == 0 || seen["b"] == 0 {
+		t.Errorf("expect requests spread to alive backends, but got %v", seen)
+	}
+
+	pool, err := newUpstreamPool(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		conn, b, err := pool.dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if b.addr == dead {
+			t.Errorf("expect dead backend skipped")
+		}
+	}
+}
+
+func TestHTTPTunnelPathRouting(t *testing.T) {
+	newPathBackend := func(name string) string {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s %s", name, r.URL.Path, r.Header.Get("X-Forwarded-Prefix"))
+		}))
+		t.Cleanup(backend.Close)
+		return backend.Listener.Addr().String()
+	}
+	tt := startTestTunnel(t, ProxyOptions{
+		Proto:     HTTP,
+		Subdomain: "team",
+		LocalAddr: newPathBackend("web"),
+		GroupKey:  "team-key",
+	})
+	// other prefixes of the host need its group key
+	for _, key := range []string{"", "wrong-key"} {
+		px, err := NewClient(tt.server.URL).RunProxy(ProxyOptions{Proto: HTTP, Subdomain: "team", LocalAddr: newPathBackend("evil"), PathPrefix: "/login", GroupKey: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr, err := px.WaitRemoteAddr(2 * time.Second); err == nil {
+			t.Errorf("expect prefix of others rejected with key %q, but got %s", key, addr)
+		}
+		px.Close()
+	}
+	opts := ProxyOptions{
+		Proto:       HTTP,
+		Subdomain:   "team",
+		LocalAddr:   newPathBackend("api"),
+		PathPrefix:  "/api/",
+		StripPrefix: true,
+		GroupKey:    "team-key",
+	}
+	px, err := NewClient(tt.server.URL).RunProxy(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { px.Close() })
+	if addr, err := px.WaitRemoteAddr(5 * time.Second); err != nil || addr != "team.pxl.test/api" {
+		t.Fatalf("unexpected remote addr %q, err %v", addr, err)
+	}
+
+	for path, expect := range map[string]string{
+		"/":          "web / ",
+		"/apix":      "web /apix ",
+		"/api":       "api / /api",
+		"/api/users": "api /users /api",
+	} {
+		resp := tt.get(t, path, nil)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != expect {
+			t.Errorf("%s expect %q, but got %q", path, expect, body)
+		}
+	}
+}
+
+func TestReverseConnTunnelClosed(t *testing.T) {
+	ctrl := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err == nil {
+			ctrl <- conn
+		}
+	}))
+	t.Cleanup(server.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	tunnel := &webSocketTunnel{wsconn: <-ctrl, done: make(chan struct{})}
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := tunnel.RequestNewConn("203.0.113.1:4000")
+		result <- err
+	}()
+	var msg message
+	if err := client.ReadJSON(&msg); err != nil || msg.Type != TYPE_NEWCONN {
+		t.Fatalf("expect connection request, but got %+v, err %v", msg, err)
+	}
+	// the member leaves without answering
+	close(tunnel.done)
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrTunnelClosed) {
+			t.Errorf("expect tunnel closed, but got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expect request given up when tunnel closed")
+	}
+	namedConnectionMu.Lock()
+	_, waiting := namedConnection[msg.Body]
+	namedConnectionMu.Unlock()
+	if waiting {
+		t.Error("expect waiter removed")
+	}
+}
+
+func TestHTTPPathTunnel(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "1", Path: "/"})
+			http.Redirect(w, r, "/home", http.StatusFound)
+			return
+		}
+		io.WriteString(w, r.URL.Path)
+	}))
+	t.Cleanup(backend.Close)
+	ps := NewProxyServer(testDomain)
+	ps.PathTunnels = true
+	server := httptest.NewServer(ps)
+	t.Cleanup(server.Close)
+
+	px, err := NewClient(server.URL).RunProxy(ProxyOptions{
+		Proto:     HTTP,
+		Subdomain: "app",
+		LocalAddr: backend.Listener.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { px.Close() })
+	addr, err := px.WaitRemoteAddr(5 * time.Second)
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	if expect := testDomain + ":" + port + "/t/app/"; err != nil || addr != expect {
+		t.Fatalf("expect remote addr %q, but got %q, err %v", expect, addr, err)
+	}
+	get := func(client *http.Client, host, path string) *http.Response {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req.Host = host
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := get(testHTTPClient, testDomain+":"+port, "/t/app/echo")
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "/echo" {
+		t.Errorf("expect prefix stripped, but got %q", body)
+	}
+
+	// only base domains serve path tunnels, not the address client dialed
+	resp = get(testHTTPClient, server.Listener.Addr().String(), "/t/app/echo")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expect 404 on other hosts, but got %d", resp.StatusCode)
+	}
+
+	noRedirect := &http.Client{
+		Timeout:       10 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp = get(noRedirect, testDomain, "/t/app/login")
+	resp.Body.Close()
+	if loc := resp.Header.Get("Location"); loc != "/t/app/home" {
+		t.Errorf("expect redirect under prefix, but got %q", loc)
+	}
+	if cookie := resp.Header.Get("Set-Cookie"); !strings.Contains(cookie, "Path=/t/app/") {
+		t.Errorf("expect cookie path under prefix, but got %q", cookie)
+	}
+}
+
+func TestHTTPPortTunnel(t *testing.T) {
+	backend := newTestBackend(t)
+	ps := NewProxyServer("127.0.0.1")
+	server := httptest.NewServer(ps)
+	t.Cleanup(server.Close)
+
+	px, err := NewClient(server.URL).RunProxy(ProxyOptions{
+		Proto:      HTTP,
+		LocalAddr:  backend.Listener.Addr().String(),
+		PortTunnel: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { px.Close() })
+	addr, err := px.WaitRemoteAddr(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := testHTTPClient.Get("http://" + addr + "/headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var header http.Header
+	if err := json.NewDecoder(resp.Body).Decode(&header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("X-Forwarded-Host") != addr {
+		t.Errorf("expect forwarded host %s, but got %v", addr, header)
+	}
+
+	// keep-alive connections are closed with the port
+	px.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ps.RLock()
+		n := len(ps.portGroups)
+		ps.RUnlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("port group not released")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if resp, err := testHTTPClient.Get("http://" + addr + "/headers"); err == nil {
+		resp.Body.Close()
+		t.Errorf("expect port closed, but got %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPTunnelWildcardAndHostname(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host)
+	}))
+	t.Cleanup(backend.Close)
+	_, key, _ := ed25519.GenerateKey(nil)
+	_, other, _ := ed25519.GenerateKey(nil)
+	ps := NewProxyServer(testDomain)
+	ps.lookupTXT = func(name string) ([]string, error) {
+		switch name {
+		case "_proxylocal-challenge.dev.example.com":
+			return []string{"v=spf1 -all", hostnameToken(key.Public().(ed25519.PublicKey))}, nil
+		case "_proxylocal-challenge.other.example.com":
+			return []string{hostnameToken(other.Public().(ed25519.PublicKey))}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	server := httptest.NewServer(ps)
+	t.Cleanup(server.Close)
+	px, err := NewClient(server.URL).RunProxy(ProxyOptions{
+		Proto:       HTTP,
+		Subdomain:   "foo",
+		LocalAddr:   backend.Listener.Addr().String(),
+		HostHeader:  HOST_HEADER_PRESERVE,
+		Wildcard:    true,
+		IdentityKey: key,
+		// only dev.example.com has the TXT record of this key
+		Hostnames: []string{"Dev.Example.com", "other.example.com", "localhost", "127.0.0.2", "printer.local", "bar." + testDomain},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { px.Close() })
+	tt := &testTunnel{server: server, ps: ps}
+	deadline := time.Now().Add(10 * time.Second)
+	for ps.routes.match("dev.example.com", "/") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("custom hostname not routed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	for _, host := range []string{"a.foo." + testDomain, "a.b.foo." + testDomain, "dev.example.com"} {
+		tt.host = host
+		resp := tt.get(t, "/", nil)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != host {
+			t.Errorf("expect %s routed to tunnel, but got %d %q", host, resp.StatusCode, body)
+		}
+	}
+	for _, host := range []string{"other.example.com", "localhost", "127.0.0.2", "printer.local", "bar." + testDomain, "foo.bar." + testDomain} {
+		if ps.routes.match(host, "/") != nil {
+			t.Errorf("expect %s not routed", host)
+		}
+	}
+}
+
+func TestCheckPublicHostname(t *testing.T) {
+	for _, name := range []string{"dev.example.com", "a-b.example.co.uk"} {
+		if err := checkPublicHostname(name); err != nil {
+			t.Errorf("expect %s accepted, but got %v", name, err)
+		}
+	}
+	for _, name := range []string{"localhost", "a.localhost", "10.0.0.1", "::1", "nas", "nas.lan", "db.internal", "x.home.arpa", "bad_name.example.com"} {
+		if err := checkPublicHostname(name); err == nil {
+			t.Errorf("expect %s rejected", name)
+		}
+	}
+}
+
+func TestVerifyHostname(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(nil)
+	other, _, _ := ed25519.GenerateKey(nil)
+	var lookups []string
+	ps := NewProxyServer(testDomain)
+	ps.lookupTXT = func(name string) ([]string, error) {
+		lookups = append(lookups, name)
+		switch name {
+		case "_proxylocal-challenge.mine.example.com":
+			return []string{hostnameToken(pub)}, nil
+		case "_proxylocal-challenge.theirs.example.com":
+			return []string{hostnameToken(other)}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	if err := ps.verifyHostname("mine.example.com", pub); err != nil {
+		t.Errorf("expect hostname with TXT of the key verified, but got %v", err)
+	}
+	// pointing the hostname at the server is not enough, the record must name the key
+	for _, name := range []string{"theirs.example.com", "cname-only.example.com"} {
+		err := ps.verifyHostname(name, pub)
+		if !errors.Is(err, ErrHostnameVerify) || !strings.Contains(err.Error(), hostnameToken(pub)) {
+			t.Errorf("expect %s rejected with the record to add, but got %v", name, err)
+		}
+	}
+	for _, name := range lookups {
+		if !strings.HasPrefix(name, challengeLabel) {
+			t.Errorf("expect only challenge records looked up, but got %s", name)
+		}
+	}
+}
+
+func TestMultipleDomains(t *testing.T) {
+	backend := newTestBackend(t)
+	ps := NewProxyServer(strings.ToUpper(testDomain)) // domains are lowercased
+	dc, err := ParseDomainConfig("Example.test,protocols=http,token=s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.AddDomain(dc); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(ps)
+	t.Cleanup(server.Close)
+
+	remoteAddr := func(opts ProxyOptions) (string, error) {
+		opts.LocalAddr = backend.Listener.Addr().String()
+		px, err := NewClient(server.URL).RunProxy(opts)
+		if err != nil {
+			return "", err
+		}
+		t.Cleanup(func() { px.Close() })
+		return px.WaitRemoteAddr(2 * time.Second)
+	}
+	if addr, err := remoteAddr(ProxyOptions{Proto: HTTP, Subdomain: "a"}); addr != "a."+testDomain {
+		t.Errorf("expect default domain, but got %q, err %v", addr, err)
+	}
+	if addr, err := remoteAddr(ProxyOptions{Proto: HTTP, Subdomain: "a", Domain: "example.test", Token: "s3cret"}); addr != "a.example.test" {
+		t.Errorf("expect picked domain, but got %q, err %v", addr, err)
+	}
+	// the user token is not the token of domain
+	ps.Policy.Users = map[string]*Identity{"alice-token": {Name: "alice", Prefixes: []string{"alice-"}}}
+	if addr, err := remoteAddr(ProxyOptions{Proto: HTTP, Domain: "example.test", Token: "s3cret", UserToken: "alice-token"}); !strings.HasPrefix(addr, "alice-") {
+		t.Errorf("expect random name of user, but got %q, err %v", addr, err)
+	}
+	for _, opts := range []ProxyOptions{
+		{Proto: HTTP, Subdomain: "alice-b", Domain: "example.test", Token: "s3cret"},
+		{Proto: HTTP, Subdomain: "alice-b", Domain: "example.test", Token: "alice-token"},
+		{Proto: HTTP, Subdomain: "b", Domain: "example.test"},
+		{Proto: TCP, Domain: "example.test", Token: "s3cret"},
+		{Proto: HTTP, Subdomain: "b", Domain: "unknown.test"},
+	} {
+		if addr, err := remoteAddr(opts); err == nil {
+			t.Errorf("expect %+v rejected, but got %s", opts, addr)
+		}
+	}
+
+	// error pages name the domain visited
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Host = "nope.example.test"
+	req.Header.Set("Accept", "application/json")
+	resp, err := testHTTPClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"domain":"example.test"`) {
+		t.Errorf("expect not found page of example.test, but got %s", body)
+	}
+}
+
+func TestIdentityKeyOldServer(t *testing.T) {
+	// old servers register the tunnel without asking for the key
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteJSON(&message{Type: TYPE_REMOTEADDR, Body: "a." + testDomain})
+		conn.ReadMessage()
+	}))
+	t.Cleanup(server.Close)
+	_, key, _ := ed25519.GenerateKey(nil)
+	_, err := NewClient(server.URL).RunProxy(ProxyOptions{Proto: HTTP, LocalAddr: "127.0.0.1:1", IdentityKey: key})
+	if err != ErrIdentityUnsupported {
+		t.Errorf("expect %v, but got %v", ErrIdentityUnsupported, err)
+	}
+}
+
+func TestIdentityChallengeBoundToHost(t *testing.T) {
+	ctrl := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err == nil {
+			ctrl <- conn
+		}
+	}))
+	t.Cleanup(server.Close)
+	_, key, _ := ed25519.GenerateKey(nil)
+	verify := func(clientHost string) error {
+		client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		tunnel := &webSocketTunnel{wsconn: <-ctrl}
+		defer tunnel.wsconn.Close()
+		go answerChallenge(client, key, clientHost)
+		return tunnel.verifyIdentity(key.Public().(ed25519.PublicKey), testDomain)
+	}
+	if err := verify(strings.ToUpper(testDomain) + ":443"); err != nil {
+		t.Errorf("expect signature for this server accepted, but got %v", err)
+	}
+	// a malicious server relaying our challenge gets a signature for its own host
+	if err := verify("evil.example.com"); !errors.Is(err, ErrIdentityVerify) {
+		t.Errorf("expect signature for another server rejected, but got %v", err)
+	}
+}
+
+func TestHTTPTunnelIdentityKey(t *testing.T) {
+	backend := newTestBackend(t)
+	ps := NewProxyServer(testDomain)
+	server := httptest.NewServer(ps)
+	t.Cleanup(server.Close)
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+
+	connect := func(opts ProxyOptions) (string, error) {
+		opts.Proto, opts.LocalAddr = HTTP, backend.Listener.Addr().String()
+		px, err := NewClient(server.URL).RunProxy(opts)
+		if err != nil {
+			return "", err
+		}
+		defer px.Close()
+		return px.WaitRemoteAddr(2 * time.Second)
+	}
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		key, err := LoadOrCreateIdentityKey(keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, err := connect(ProxyOptions{IdentityKey: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr != keySubdomain(key.Public().(ed25519.PublicKey))+"."+testDomain {
+			t.Errorf("expect subdomain derived from key, but got %s", addr)
+		}
+		addrs = append(addrs, addr)
+		// wait the first tunnel closed
+		for ps.routes.hasHost(addr) {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	if addrs[0] != addrs[1] {
+		t.Errorf("expect stable subdomain, but got %v", addrs)
+	}
+	subdomain := strings.TrimSuffix(addrs[0], "."+testDomain)
+	if addr, err := connect(ProxyOptions{Subdomain: subdomain}); err == nil {
+		t.Errorf("expect key subdomain rejected without the key, but got %s", addr)
+	}
+}
+
+func TestAuthorizedKeysTunnel(t *testing.T) {
+	backend := newTestBackend(t)
+	_, alice, _ := ed25519.GenerateKey(nil)
+	_, bob, _ := ed25519.GenerateKey(nil)
+	keysFile := filepath.Join(t.TempDir(), "authorized_keys")
+	_, carol, _ := ed25519.GenerateKey(nil)
+	os.WriteFile(keysFile, []byte(`subdomains="alice-*",max-tunnels=1 ed25519 `+encodePublicKey(alice.Public().(ed25519.PublicKey))+"\n"+
+		`subdomains="carol-*" ed25519 `+encodePublicKey(carol.Public().(ed25519.PublicKey))+"\n"), 0644)
+	ak, err := LoadAuthorizedKeys(keysFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := NewProxyServer(testDomain)
+	ps.AuthorizedKeys = ak
+	server := httptest.NewServer(ps)
+	t.Cleanup(server.Close)
+
+	connect := func(opts ProxyOptions) (string, error) {
+		if opts.Proto == "" {
+			opts.Proto = HTTP
+		}
+		opts.LocalAddr = backend.Listener.Addr().String()
+		px, err := NewClient(server.URL).RunProxy(opts)
+		if err != nil {
+			return "", err
+		}
+		t.Cleanup(func() { px.Close() })
+		return px.WaitRemoteAddr(2 * time.Second)
+	}
+	addr, err := connect(ProxyOptions{IdentityKey: alice})
+	if err != nil || !strings.HasPrefix(addr, "alice-") {
+		t.Fatalf("expect subdomain in namespace of the key, but got %q, err %v", addr, err)
+	}
+	for _, opts := range []ProxyOptions{
+		{IdentityKey: alice},     // max tunnels
+		{IdentityKey: bob},       // unknown key
+		{Subdomain: "anonymous"}, // no key
+		{Proto: TCP, Private: "db", Secret: testSecret, IdentityKey: carol}, // private name out of namespace
+	} {
+		if addr, err := connect(opts); err == nil {
+			t.Errorf("expect rejected, but got %s", addr)
+		}
+	}
+	if addr, err := connect(ProxyOptions{Proto: TCP, Private: "carol-db", Secret: testSecret, IdentityKey: carol}); addr != "private:carol-db" {
+		t.Errorf("expect private name in namespace, but got %q, err %v", addr, err)
+	}
+}
+
+// newTestClientCert create a CA and a client certificate signed by it,
+// return the CA pool and PEM files of the client certificate
+func newTestClientCert(t *testing.T, commonName string) (pool *x509.CertPool, certFile, keyFile string) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(key)
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	pem.Encode(mustCreate(t, certFile), &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pem.Encode(mustCreate(t, keyFile), &pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	pool = x509.NewCertPool()
+	pool.AddCert(ca)
+	return pool, certFile, keyFile
+}
+
+func TestMutualTLS(t *testing.T) {
+	backend := newTestBackend(t)
+	pool, certFile, keyFile := newTestClientCert(t, "alice")
+	ps := NewProxyServer(testDomain)
+	ps.ClientCAs = pool
+	server := httptest.NewUnstartedServer(ps)
+	server.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	pem.Encode(mustCreate(t, caFile), &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	connect := func(o ClientTLS) (string, error) {
+		client := NewClient(server.URL)
+		if err := client.SetTLS(o); err != nil {
+			t.Fatal(err)
+		}
+		px, err := client.RunProxy(ProxyOptions{Proto: HTTP, LocalAddr: backend.Listener.Addr().String()})
+		if err != nil {
+			return "", err
+		}
+		t.Cleanup(func() { px.Close() })
+		return px.WaitRemoteAddr(2 * time.Second)
+	}
+	addr, err := connect(ClientTLS{CertFile: certFile, KeyFile: keyFile, CAFile: caFile})
+	if err != nil || !strings.HasPrefix(addr, "alice-") {
+		t.Fatalf("expect subdomain of certificate identity, but got %q, err %v", addr, err)
+	}
+	// reverse connections also pass the tls handshake
+	req, _ := http.NewRequest("GET", server.URL+"/headers", nil)
+	req.Host = addr
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expect visitor served, but got %s", resp.Status)
+	}
+
+	pin := "sha256//" + publicKeyPin(server.Certificate())
+	if _, err := connect(ClientTLS{CertFile: certFile, KeyFile: keyFile, Pins: []string{pin}}); err != nil {
+		t.Errorf("expect pinned server accepted, but got %v", err)
+	}
+	for _, o := range []ClientTLS{
+		{CAFile: caFile}, // no client certificate
+		{CertFile: certFile, KeyFile: keyFile, Pins: []string{"sha256//AAAA"}},
+	} {
+		if addr, err := connect(o); err == nil {
+			t.Errorf("expect %+v rejected, but got %s", o, addr)
+		}
+	}
+}
+
+func TestReverseConnToken(t *testing.T) {
+	ctrl := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ws/reverse" {
+			wsProxyHandler(w, r)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err == nil {
+			ctrl <- conn
+		}
+	}))
+	t.Cleanup(server.Close)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	client, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	tunnel := &webSocketTunnel{wsconn: <-ctrl}
+
+	const visitor = "203.0.113.1:4000"
+	result := make(chan error, 1)
+	go func() {
+		conn, err := tunnel.RequestNewConn(visitor)
+		if conn != nil {
+			conn.Close()
+		}
+		result <- err
+	}()
+	var msg message
+	if err := client.ReadJSON(&msg); err != nil || msg.Type != TYPE_NEWCONN || !strings.HasPrefix(msg.Body, visitor+" ") {
+		t.Fatalf("expect connection request with token, but got %+v, err %v", msg, err)
+	}
+
+	// knowing the visitor address is not enough
+	guess, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/reverse", http.Header{"X-Proxy-For": []string{visitor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	guess.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := guess.NextReader(); err == nil {
+		t.Error("expect guessed reverse connection closed")
+	}
+	guess.Close()
+	select {
+	case err := <-result:
+		t.Fatalf("expect request still waiting, but got %v", err)
+	default:
+	}
+
+	rconn, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/reverse", http.Header{"X-Proxy-For": []string{msg.Body}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rconn.Close()
+	if err := <-result; err != nil {
+		t.Errorf("expect reverse connection with token accepted, but got %v", err)
+	}
+}
+
+func TestPrivateTunnel(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	ps := NewProxyServer(testDomain)
+	server := httptest.NewServer(ps)
+	t.Cleanup(server.Close)
+
+	px, err := NewClient(server.URL).RunProxy(ProxyOptions{Proto: TCP, LocalAddr: echo.Addr().String(), Private: "db", Secret: testSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { px.Close() })
+	if addr, err := px.WaitRemoteAddr(2 * time.Second); err != nil || addr != "private:db" {
+		t.Fatalf("unexpected remote addr %q, err %v", addr, err)
+	}
+
+	visit := func(secret string) (string, error) {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { lis.Close() })
+		go NewClient(server.URL).Visit("db", secret, lis)
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.WriteString(conn, "ping"); err != nil {
+			return "", err
+		}
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		return string(buf), err
+	}
+	if got, err := visit(testSecret); err != nil || got != "ping" {
+		t.Errorf("expect echo through private tunnel, but got %q, err %v", got, err)
+	}
+	if got, err := visit("wrong-secret-of-the-db"); err == nil {
+		t.Errorf("expect wrong secret rejected, but got %q", got)
+	}
+	if _, err := NewClient(server.URL).RunProxy(ProxyOptions{Proto: TCP, LocalAddr: echo.Addr().String(), Private: "db"}); !errors.Is(err, ErrSecretRequired) {
+		t.Errorf("expect secret required, but got %v", err)
+	}
+	if _, err := NewClient(server.URL).RunProxy(ProxyOptions{Proto: TCP, LocalAddr: echo.Addr().String(), Private: "db", Secret: "s3cret"}); !errors.Is(err, ErrSecretWeak) {
+		t.Errorf("expect short secret rejected, but got %v", err)
+	}
+}
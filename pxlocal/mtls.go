@@ -0,0 +1,128 @@
+package pxlocal
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	ErrClientCert = errors.New("client certificate rejected")
+	ErrServerPin  = errors.New("server public key does not match any pin")
+)
+
+// ClientTLS configure the tls connection from client to proxy server,
+// used for both control and reverse connections
+type ClientTLS struct {
+	CertFile string // client certificate, required when server enables mutual tls
+	KeyFile  string
+	CAFile   string // CA bundle to verify server, default use system pool
+	// sha256 of server public key in base64, ex: sha256//xxx, any one matches.
+	// Without CAFile, pins replace the CA verify so self signed server works
+	Pins []string
+}
+
+func (o ClientTLS) config() (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if o.CAFile != "" {
+		pool, err := LoadCertPool(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if len(o.Pins) > 0 {
+		pins := make(map[string]bool)
+		for _, pin := range o.Pins {
+			pins[strings.TrimPrefix(pin, "sha256//")] = true
+		}
+		cfg.InsecureSkipVerify = o.CAFile == ""
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 || !pins[publicKeyPin(cs.PeerCertificates[0])] {
+				return ErrServerPin
+			}
+			return nil
+		}
+	}
+	return cfg, nil
+}
+
+// publicKeyPin is the base64 sha256 of subject public key info, same as curl --pinnedpubkey
+func publicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// SetTLS is used when server address is https://...
+func (c *Client) SetTLS(o ClientTLS) error {
+	cfg, err := o.config()
+	if err != nil {
+		return err
+	}
+	c.tlsConfig = cfg
+	return nil
+}
+
+// LoadCertPool read PEM certificates from file
+func LoadCertPool(filename string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", filename)
+	}
+	return pool, nil
+}
+
+// requireClientCert reject control and reverse connections without a verified certificate,
+// visitors of tunnels do not need one
+func (ps *ProxyServer) requireClientCert(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ps.ClientCAs != nil && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			http.Error(w, ErrClientCert.Error(), http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// certIdentity map common name or the first dns name of client certificate to a user,
+// with users file only listed users are accepted, otherwise the user own <name>-
+func (ps *ProxyServer) certIdentity(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, ErrClientCert
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	name := cert.Subject.CommonName
+	if name == "" && len(cert.DNSNames) > 0 {
+		name = cert.DNSNames[0]
+	}
+	if name == "" {
+		return nil, fmt.Errorf("%w: no name in certificate", ErrClientCert)
+	}
+	for _, user := range ps.Policy.Users {
+		if user.Name == name {
+			return user, nil
+		}
+	}
+	if len(ps.Policy.Users) > 0 {
+		return nil, fmt.Errorf("%w: unknown user %s", ErrClientCert, name)
+	}
+	label, _, _ := strings.Cut(strings.ToLower(name), ".")
+	return &Identity{Name: name, Prefixes: []string{label + "-"}}, nil
+}
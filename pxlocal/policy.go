@@ -0,0 +1,221 @@
+package pxlocal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrSubdomainInvalid    = errors.New("invalid subdomain")
+	ErrSubdomainReserved   = errors.New("subdomain is reserved")
+	ErrSubdomainNotAllowed = errors.New("subdomain not allowed for this user")
+	ErrSubdomainExhausted  = errors.New("no free random subdomain")
+)
+
+// DefaultReservedNames can not be claimed by clients
+var DefaultReservedNames = []string{"www", "api", "admin", "mail", "smtp", "ftp", "ns", "ns1", "ns2", "dns", "static", "t"}
+
+// rfc 1123 label: letters, digits and hyphen, not start or end with hyphen
+var labelRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// prefix of labels, may end with hyphen, ex: alice-
+var prefixRe = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,61}$`)
+
+func checkPrefix(prefix string) error {
+	if !prefixRe.MatchString(prefix) {
+		return fmt.Errorf("%w: prefix %q", ErrSubdomainInvalid, prefix)
+	}
+	return nil
+}
+
+func checkLabel(name string) error {
+	if len(name) > 63 || !labelRe.MatchString(name) {
+		return fmt.Errorf("%w: %q", ErrSubdomainInvalid, name)
+	}
+	return nil
+}
+
+// Identity is the user behind a tunnel client
+type Identity struct {
+	Name     string
+	Prefixes []string // subdomain prefixes the user may claim, ex: alice-
+	Names    []string // exact subdomains the user may claim
+}
+
+func (id *Identity) allowed(name string) bool {
+	for _, n := range id.Names {
+		if name == n {
+			return true
+		}
+	}
+	for _, prefix := range id.Prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (id *Identity) patterns() string {
+	var patterns []string
+	for _, prefix := range id.Prefixes {
+		patterns = append(patterns, prefix+"*")
+	}
+	return strings.Join(append(patterns, id.Names...), ", ")
+}
+
+// SubdomainPolicy decide which subdomains a client may claim
+type SubdomainPolicy struct {
+	MinLength int // apply to names chosen by client
+	MaxLength int // no more then 63
+	Reserved  []string
+	Users     map[string]*Identity // key is the token of user
+}
+
+func NewSubdomainPolicy() *SubdomainPolicy {
+	return &SubdomainPolicy{MinLength: 1, MaxLength: 63, Reserved: DefaultReservedNames}
+}
+
+// identify return the user of token, nil means anonymous.
+// It is the user token of client, not the token of domain policy
+func (p *SubdomainPolicy) identify(token string) *Identity {
+	if token == "" {
+		return nil
+	}
+	return p.Users[token]
+}
+
+// SetReserved validate and lowercase names can not be claimed
+func (p *SubdomainPolicy) SetReserved(names []string) error {
+	reserved := make([]string, 0, len(names))
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if err := checkLabel(name); err != nil {
+			return fmt.Errorf("reserved name: %w", err)
+		}
+		reserved = append(reserved, name)
+	}
+	p.Reserved = reserved
+	return nil
+}
+
+func (p *SubdomainPolicy) maxLength() int {
+	if p.MaxLength <= 0 || p.MaxLength > 63 {
+		return 63
+	}
+	return p.MaxLength
+}
+
+func (p *SubdomainPolicy) isReserved(name string) bool {
+	for _, reserved := range p.Reserved {
+		if strings.EqualFold(name, reserved) {
+			return true
+		}
+	}
+	return false
+}
+
+// check name claimed by client, prefixes of users are only for themselves
+func (p *SubdomainPolicy) check(name string, id *Identity) error {
+	maxLength := p.maxLength()
+	if len(name) < p.MinLength || len(name) > maxLength || !labelRe.MatchString(name) {
+		return fmt.Errorf("%w: [%s] should be %d-%d letters, digits or hyphen", ErrSubdomainInvalid, name, p.MinLength, maxLength)
+	}
+	if p.isReserved(name) {
+		return fmt.Errorf("%w: %s", ErrSubdomainReserved, name)
+	}
+	if id != nil {
+		if !id.allowed(name) {
+			return fmt.Errorf("%w: %s can only claim %s", ErrSubdomainNotAllowed, id.Name, id.patterns())
+		}
+		return nil
+	}
+	for _, user := range p.Users {
+		if user.allowed(name) {
+			return fmt.Errorf("%w: %s belongs to %s", ErrSubdomainNotAllowed, name, user.Name)
+		}
+	}
+	return nil
+}
+
+// randomName generate a name in namespace of the user, release it when tunnel closed,
+// the random part is shortened to fit MaxLength
+func (p *SubdomainPolicy) randomName(id *Identity) (name string, release func(), err error) {
+	prefix := ""
+	if id != nil && len(id.Prefixes) > 0 {
+		prefix = id.Prefixes[0]
+	} else if id != nil && len(id.Names) > 0 {
+		name = id.Names[0]
+		if len(name) > p.maxLength() || !labelRe.MatchString(name) || p.isReserved(name) {
+			return "", nil, fmt.Errorf("%w: %s can not be used", ErrSubdomainInvalid, name)
+		}
+		return name, func() {}, nil
+	}
+	size := min(5, p.maxLength()-len(prefix))
+	if size < 1 {
+		return "", nil, fmt.Errorf("%w: prefix %s is longer than %d", ErrSubdomainInvalid, prefix, p.maxLength())
+	}
+	for i := 0; i < maxUniqTries; i++ {
+		random := uniqName(size)
+		if random == "" {
+			break
+		}
+		name = prefix + random
+		if labelRe.MatchString(name) && p.checkRandom(name, id) {
+			return name, func() { releaseName(random) }, nil
+		}
+		releaseName(random)
+	}
+	return "", nil, fmt.Errorf("%w: prefix %q, length %d", ErrSubdomainExhausted, prefix, size)
+}
+
+func (p *SubdomainPolicy) checkRandom(name string, id *Identity) bool {
+	if p.isReserved(name) {
+		return false
+	}
+	if id == nil {
+		for _, user := range p.Users {
+			if user.allowed(name) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// LoadUsers read users file, every line is: name token [prefix,...],
+// default prefix is name-, lines start with # are ignored
+func LoadUsers(filename string) (map[string]*Identity, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]*Identity)
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expect name and token", filename, lineno)
+		}
+		id := &Identity{Name: fields[0], Prefixes: []string{strings.ToLower(fields[0]) + "-"}}
+		if len(fields) > 2 {
+			id.Prefixes = strings.Split(strings.ToLower(fields[2]), ",")
+		}
+		for _, prefix := range id.Prefixes {
+			if err := checkPrefix(prefix); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", filename, lineno, err)
+			}
+		}
+		users[fields[1]] = id
+	}
+	return users, scanner.Err()
+}
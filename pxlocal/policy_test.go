@@ -0,0 +1,87 @@
+package pxlocal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSubdomainPolicy(t *testing.T) {
+	p := NewSubdomainPolicy()
+	p.MinLength = 3
+	alice := &Identity{Name: "alice", Prefixes: []string{"alice-"}}
+	p.Users = map[string]*Identity{"alice-token": alice}
+
+	Convey("Validate labels", t, func() {
+		So(p.check("my-app1", nil), ShouldBeNil)
+		for _, name := range []string{"ab", "-app", "app-", "a.b", "a_b", "App", strings.Repeat("a", 64)} {
+			So(errors.Is(p.check(name, nil), ErrSubdomainInvalid), ShouldBeTrue)
+		}
+		So(errors.Is(p.check("www", nil), ErrSubdomainReserved), ShouldBeTrue)
+	})
+
+	Convey("Users own their prefixes", t, func() {
+		So(p.identify("alice-token"), ShouldEqual, alice)
+		So(p.identify("wrong"), ShouldBeNil)
+		So(p.check("alice-blog", alice), ShouldBeNil)
+		So(errors.Is(p.check("blog", alice), ErrSubdomainNotAllowed), ShouldBeTrue)
+		So(errors.Is(p.check("alice-blog", nil), ErrSubdomainNotAllowed), ShouldBeTrue)
+
+		name, release, err := p.randomName(alice)
+		So(err, ShouldBeNil)
+		So(name, ShouldStartWith, "alice-")
+		release()
+		random := strings.TrimPrefix(name, "alice-")
+		uniqMapMu.Lock()
+		So(uniqMap[random], ShouldBeFalse)
+		uniqMapMu.Unlock()
+	})
+
+	Convey("Random names fit max length", t, func() {
+		short := &SubdomainPolicy{MaxLength: 8}
+		name, release, err := short.randomName(alice)
+		So(err, ShouldBeNil)
+		So(name, ShouldHaveLength, 8)
+		So(labelRe.MatchString(name), ShouldBeTrue)
+		release()
+		_, _, err = (&SubdomainPolicy{MaxLength: 6}).randomName(alice)
+		So(errors.Is(err, ErrSubdomainInvalid), ShouldBeTrue)
+	})
+
+	Convey("Random names give up when all are taken", t, func() {
+		full := &SubdomainPolicy{MaxLength: 7}
+		for _, c := range letterRunes {
+			full.Reserved = append(full.Reserved, "alice-"+string(c))
+		}
+		_, _, err := full.randomName(alice)
+		So(errors.Is(err, ErrSubdomainExhausted), ShouldBeTrue)
+	})
+
+	Convey("Reserved names are lowercased", t, func() {
+		So(p.SetReserved([]string{"WWW", "Blog"}), ShouldBeNil)
+		So(errors.Is(p.check("blog", nil), ErrSubdomainReserved), ShouldBeTrue)
+		p.Reserved = []string{"Blog"}
+		So(errors.Is(p.check("blog", nil), ErrSubdomainReserved), ShouldBeTrue)
+		So(p.SetReserved([]string{"bad name"}), ShouldNotBeNil)
+		So(p.SetReserved(DefaultReservedNames), ShouldBeNil)
+	})
+
+	Convey("Load users file", t, func() {
+		filename := filepath.Join(t.TempDir(), "users")
+		os.WriteFile(filename, []byte("# name token prefixes\nalice t1\nbob t2 bob-,team-\n"), 0644)
+		users, err := LoadUsers(filename)
+		So(err, ShouldBeNil)
+		So(users["t1"].Prefixes, ShouldResemble, []string{"alice-"})
+		So(users["t2"].Prefixes, ShouldResemble, []string{"bob-", "team-"})
+
+		for _, line := range []string{"bob t2 bob-,\n", "bob t2 -bob\n", "bob t2 a.b-\n"} {
+			os.WriteFile(filename, []byte(line), 0644)
+			_, err := LoadUsers(filename)
+			So(errors.Is(err, ErrSubdomainInvalid), ShouldBeTrue)
+		}
+	})
+}
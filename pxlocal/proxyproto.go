@@ -0,0 +1,111 @@
+package pxlocal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// PROXY protocol, spec: https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+const (
+	PROXY_PROTOCOL_V1 = "v1"
+	PROXY_PROTOCOL_V2 = "v2"
+)
+
+var (
+	ErrProxyProtocolVersion = errors.New("proxy protocol version should be v1 or v2")
+
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// revConn is a reverse connection which remembers the visitor address
+type revConn struct {
+	net.Conn
+	proxyFor string
+}
+
+func (rc *revConn) CloseRead() error  { return closeRead(rc.Conn) }
+func (rc *revConn) CloseWrite() error { return closeWrite(rc.Conn) }
+
+func visitorAddr(c net.Conn) *net.TCPAddr {
+	rc, ok := c.(*revConn)
+	if !ok {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(rc.proxyFor)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	var p int
+	fmt.Sscanf(port, "%d", &p)
+	return &net.TCPAddr{IP: ip, Port: p}
+}
+
+// writeProxyHeader send PROXY protocol header, src or dst can be nil when unknown
+func writeProxyHeader(w io.Writer, version string, src, dst *net.TCPAddr) error {
+	var header []byte
+	switch version {
+	case PROXY_PROTOCOL_V1:
+		header = proxyHeaderV1(src, dst)
+	case PROXY_PROTOCOL_V2:
+		header = proxyHeaderV2(src, dst)
+	default:
+		return ErrProxyProtocolVersion
+	}
+	_, err := w.Write(header)
+	return err
+}
+
+func proxyHeaderV1(src, dst *net.TCPAddr) []byte {
+	if src == nil || dst == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP4"
+	if src.IP.To4() == nil || dst.IP.To4() == nil {
+		family = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+		family, proxyIP(src.IP, family), proxyIP(dst.IP, family), src.Port, dst.Port))
+}
+
+// proxyIP format ip in family, ipv4 is written as ::ffff:a.b.c.d when families are mixed
+func proxyIP(ip net.IP, family string) string {
+	if family == "TCP6" {
+		if ip4 := ip.To4(); ip4 != nil {
+			return "::ffff:" + ip4.String()
+		}
+		return ip.To16().String()
+	}
+	return ip.To4().String()
+}
+
+func proxyHeaderV2(src, dst *net.TCPAddr) []byte {
+	buf := bytes.NewBuffer(nil)
+	buf.Write(proxyV2Signature)
+	if src == nil || dst == nil {
+		// command LOCAL, no address
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+	buf.WriteByte(0x21) // version 2, command PROXY
+	var addrs []byte
+	if srcIP, dstIP := src.IP.To4(), dst.IP.To4(); srcIP != nil && dstIP != nil {
+		buf.WriteByte(0x11) // TCP over IPv4
+		addrs = append(append(addrs, srcIP...), dstIP...)
+	} else {
+		buf.WriteByte(0x21) // TCP over IPv6, ipv4 of mixed families is v4-mapped by To16
+		addrs = append(append(addrs, src.IP.To16()...), dst.IP.To16()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(src.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(dst.Port))
+	binary.Write(buf, binary.BigEndian, uint16(len(addrs)))
+	buf.Write(addrs)
+	return buf.Bytes()
+}
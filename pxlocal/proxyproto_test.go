@@ -0,0 +1,72 @@
+package pxlocal
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestProxyHeaderV1(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 5678}
+	dst := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 22}
+	buf := bytes.NewBuffer(nil)
+	if err := writeProxyHeader(buf, PROXY_PROTOCOL_V1, src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "PROXY TCP4 1.2.3.4 127.0.0.1 5678 22\r\n" {
+		t.Fatalf("unexpected header %q", buf.String())
+	}
+
+	// localhost often resolves to ::1 while visitor is ipv4
+	buf.Reset()
+	writeProxyHeader(buf, PROXY_PROTOCOL_V1, src, &net.TCPAddr{IP: net.ParseIP("::1"), Port: 22})
+	if buf.String() != "PROXY TCP6 ::ffff:1.2.3.4 ::1 5678 22\r\n" {
+		t.Fatalf("unexpected mixed header %q", buf.String())
+	}
+
+	buf.Reset()
+	writeProxyHeader(buf, PROXY_PROTOCOL_V1, nil, dst)
+	if buf.String() != "PROXY UNKNOWN\r\n" {
+		t.Fatalf("unexpected header %q", buf.String())
+	}
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 0x1234}
+	dst := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 22}
+	buf := bytes.NewBuffer(nil)
+	if err := writeProxyHeader(buf, PROXY_PROTOCOL_V2, src, dst); err != nil {
+		t.Fatal(err)
+	}
+	expect := append([]byte(nil), proxyV2Signature...)
+	expect = append(expect, 0x21, 0x11, 0x00, 12,
+		1, 2, 3, 4, 127, 0, 0, 1, 0x12, 0x34, 0x00, 22)
+	if !bytes.Equal(buf.Bytes(), expect) {
+		t.Fatalf("unexpected header %x", buf.Bytes())
+	}
+
+	src.IP = net.ParseIP("::1")
+	buf.Reset()
+	writeProxyHeader(buf, PROXY_PROTOCOL_V2, src, dst)
+	if buf.Len() != 16+36 || buf.Bytes()[13] != 0x21 {
+		t.Fatalf("unexpected ipv6 header %x", buf.Bytes())
+	}
+	// dst is ipv4, written as v4-mapped address
+	if mapped := buf.Bytes()[16+16 : 16+32]; !bytes.Equal(mapped, net.ParseIP("::ffff:127.0.0.1").To16()) {
+		t.Fatalf("unexpected mapped address %x", mapped)
+	}
+
+	if err := writeProxyHeader(buf, "v3", src, dst); err != ErrProxyProtocolVersion {
+		t.Fatalf("expect version error, but got %v", err)
+	}
+}
+
+func TestVisitorAddr(t *testing.T) {
+	addr := visitorAddr(&revConn{proxyFor: "8.8.8.8:53"})
+	if addr == nil || addr.Port != 53 || addr.IP.String() != "8.8.8.8" {
+		t.Fatalf("unexpected visitor addr %v", addr)
+	}
+	if visitorAddr(&revConn{proxyFor: "12"}) != nil {
+		t.Fatal("expect nil for http style name")
+	}
+}
@@ -0,0 +1,206 @@
+package pxlocal
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const defaultRewriteBodyLimit = 2 << 20
+
+var (
+	loopbackHosts    = []string{"localhost", "127.0.0.1", "[::1]"}
+	cookieDomainRe   = regexp.MustCompile(`(?i)(;\s*domain=)([^;]*)`)
+	refreshURLRe     = regexp.MustCompile(`(?i)(url=)(.*)$`)
+	rewriteBodyTypes = []string{"text/html", "application/json", "application/xhtml+xml"}
+)
+
+// responseRewriter map local origins in responses back to the public url
+type responseRewriter struct {
+	origins     []string // ex: http://localhost:5037
+	hosts       []string // used for cookie domain
+	rewriteBody bool
+	bodyLimit   int64
+}
+
+func newResponseRewriter(localAddr string, rewriteBody bool, bodyLimit int64) *responseRewriter {
+	if bodyLimit <= 0 {
+		bodyLimit = defaultRewriteBodyLimit
+	}
+	rw := &responseRewriter{
+		rewriteBody: rewriteBody,
+		bodyLimit:   bodyLimit,
+	}
+	rw.addLocal(localAddr)
+	return rw
+}
+
+// addLocal add origins of another local address, used by load balanced backends
+func (rw *responseRewriter) addLocal(localAddr string) {
+	host, port, err := net.SplitHostPort(localAddr)
+	if err != nil {
+		host, port = localAddr, "80"
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	hosts := []string{host}
+	for _, h := range loopbackHosts {
+		if h == host {
+			hosts = loopbackHosts
+			break
+		}
+	}
+	for _, h := range hosts {
+		rw.hosts = append(rw.hosts, strings.Trim(h, "[]"))
+		for _, scheme := range []string{"http", "https"} {
+			rw.origins = append(rw.origins, scheme+"://"+h+":"+port)
+			if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+				rw.origins = append(rw.origins, scheme+"://"+h)
+			}
+		}
+	}
+}
+
+// publicOrigin comes from forwarding headers set by proxylocal server
+func publicOrigin(req *http.Request) (origin string, host string) {
+	host = req.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		return "", ""
+	}
+	proto := req.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "http"
+	}
+	return proto + "://" + host, host
+}
+
+func (rw *responseRewriter) rewriteURL(s string, public string) string {
+	for _, origin := range rw.origins {
+		if !strings.HasPrefix(s, origin) {
+			continue
+		}
+		rest := s[len(origin):]
+		if rest == "" || strings.ContainsAny(rest[:1], "/?#") {
+			return public + rest
+		}
+	}
+	return s
+}
+
+func (rw *responseRewriter) rewriteCookie(s string, publicHost string) string {
+	if h, _, err := net.SplitHostPort(publicHost); err == nil {
+		publicHost = h
+	}
+	return cookieDomainRe.ReplaceAllStringFunc(s, func(attr string) string {
+		m := cookieDomainRe.FindStringSubmatch(attr)
+		domain := strings.TrimPrefix(strings.TrimSpace(m[2]), ".")
+		for _, h := range rw.hosts {
+			if strings.EqualFold(domain, h) {
+				return m[1] + publicHost
+			}
+		}
+		return attr
+	})
+}
+
+func (rw *responseRewriter) ModifyResponse(resp *http.Response) error {
+	public, publicHost := publicOrigin(resp.Request)
+	if public == "" {
+		return nil
+	}
+	for _, key := range []string{"Location", "Content-Location"} {
+		if v := resp.Header.Get(key); v != "" {
+			resp.Header.Set(key, rw.rewriteURL(v, public))
+		}
+	}
+	if v := resp.Header.Get("Refresh"); v != "" {
+		resp.Header.Set("Refresh", refreshURLRe.ReplaceAllStringFunc(v, func(s string) string {
+			m := refreshURLRe.FindStringSubmatch(s)
+			return m[1] + rw.rewriteURL(strings.Trim(m[2], `'"`), public)
+		}))
+	}
+	if cookies := resp.Header.Values("Set-Cookie"); len(cookies) > 0 {
+		resp.Header.Del("Set-Cookie")
+		for _, c := range cookies {
+			resp.Header.Add("Set-Cookie", rw.rewriteCookie(c, publicHost))
+		}
+	}
+	if rw.rewriteBody {
+		return rw.modifyBody(resp, public)
+	}
+	return nil
+}
+
+// an origin in body ends before one of these bytes, so http://localhost:5037 is not
+// replaced inside http://localhost:50370 or http://localhost.example.com
+const originBoundary = "/\"'?# \t\r\n"
+
+// replaceOrigin replace origin followed by a boundary byte or end of data
+func replaceOrigin(body []byte, origin, public, boundary string) []byte {
+	var out []byte
+	for {
+		i := bytes.Index(body, []byte(origin))
+		if i < 0 {
+			if out == nil {
+				return body
+			}
+			return append(out, body...)
+		}
+		end := i + len(origin)
+		out = append(out, body[:i]...)
+		if end == len(body) || strings.IndexByte(boundary, body[end]) >= 0 {
+			out = append(out, public...)
+		} else {
+			out = append(out, origin...)
+		}
+		body = body[end:]
+	}
+}
+
+func shouldRewriteBody(resp *http.Response) bool {
+	if resp.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	for _, t := range rewriteBodyTypes {
+		if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// modifyBody replace local origins in html or json, body bigger then limit is left untouched
+func (rw *responseRewriter) modifyBody(resp *http.Response, public string) error {
+	if resp.Body == nil || resp.Body == http.NoBody || !shouldRewriteBody(resp) {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, rw.bodyLimit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > rw.bodyLimit {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+	jsonPublic := strings.ReplaceAll(public, "/", `\/`)
+	for _, origin := range rw.origins {
+		body = replaceOrigin(body, origin, public, originBoundary)
+		// escaped slashes in json, ex: http:\/\/localhost:5037\/api
+		body = replaceOrigin(body, strings.ReplaceAll(origin, "/", `\/`), jsonPublic, originBoundary+`\`)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
@@ -0,0 +1,72 @@
+package pxlocal
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func newRewriteResponse(contentType string, body string) *http.Response {
+	req, _ := http.NewRequest("GET", "http://localhost:5037/", nil)
+	req.Header.Set("X-Forwarded-Host", "abcde.example.com")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	resp := &http.Response{
+		Header:  http.Header{},
+		Request: req,
+		Body:    io.NopCloser(strings.NewReader(body)),
+	}
+	resp.Header.Set("Content-Type", contentType)
+	return resp
+}
+
+func TestResponseRewriter(t *testing.T) {
+	Convey("Rewrite headers", t, func() {
+		rw := newResponseRewriter("localhost:5037", false, 0)
+		resp := newRewriteResponse("text/plain", "")
+		resp.Header.Set("Location", "http://127.0.0.1:5037/login?next=/")
+		resp.Header.Set("Content-Location", "http://localhost:50370/other")
+		resp.Header.Set("Refresh", "5; url=http://localhost:5037/")
+		resp.Header.Add("Set-Cookie", "sid=1; Domain=.localhost; Path=/")
+		resp.Header.Add("Set-Cookie", "uid=2; Domain=example.org")
+		So(rw.ModifyResponse(resp), ShouldBeNil)
+		So(resp.Header.Get("Location"), ShouldEqual, "https://abcde.example.com/login?next=/")
+		So(resp.Header.Get("Content-Location"), ShouldEqual, "http://localhost:50370/other")
+		So(resp.Header.Get("Refresh"), ShouldEqual, "5; url=https://abcde.example.com/")
+		So(resp.Header.Values("Set-Cookie"), ShouldResemble, []string{
+			"sid=1; Domain=abcde.example.com; Path=/",
+			"uid=2; Domain=example.org",
+		})
+	})
+
+	Convey("Rewrite body", t, func() {
+		rw := newResponseRewriter("localhost:5037", true, 0)
+		resp := newRewriteResponse("application/json", `{"url": "http:\/\/localhost:5037/a", "b": "http://localhost:5037"}`)
+		So(rw.ModifyResponse(resp), ShouldBeNil)
+		body, _ := io.ReadAll(resp.Body)
+		So(string(body), ShouldEqual, `{"url": "https:\/\/abcde.example.com/a", "b": "https://abcde.example.com"}`)
+		So(resp.ContentLength, ShouldEqual, len(body))
+
+		rw = newResponseRewriter("localhost:5037", true, 10)
+		resp = newRewriteResponse("text/html", "<a href='http://localhost:5037/'>")
+		So(rw.ModifyResponse(resp), ShouldBeNil)
+		body, _ = io.ReadAll(resp.Body)
+		So(string(body), ShouldEqual, "<a href='http://localhost:5037/'>")
+	})
+
+	Convey("Rewrite body only at origin boundary", t, func() {
+		rw := newResponseRewriter("localhost:5037", true, 0)
+		resp := newRewriteResponse("text/html", `<a href="http://localhost:50370/x">http://localhost:5037?q=1 http://localhost:5037#top</a>`)
+		So(rw.ModifyResponse(resp), ShouldBeNil)
+		body, _ := io.ReadAll(resp.Body)
+		So(string(body), ShouldEqual, `<a href="http://localhost:50370/x">https://abcde.example.com?q=1 https://abcde.example.com#top</a>`)
+
+		rw = newResponseRewriter("localhost:80", true, 0)
+		resp = newRewriteResponse("application/json", `["http://localhost:8080/", "http://localhost.example.org/", "http://localhost/a", "http:\/\/localhost\/b"]`)
+		So(rw.ModifyResponse(resp), ShouldBeNil)
+		body, _ = io.ReadAll(resp.Body)
+		So(string(body), ShouldEqual, `["http://localhost:8080/", "http://localhost.example.org/", "https://abcde.example.com/a", "https:\/\/abcde.example.com\/b"]`)
+	})
+}
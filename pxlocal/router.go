@@ -0,0 +1,228 @@
+package pxlocal
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// route is a http tunnel registered on host and path prefix
+type route struct {
+	host    string
+	prefix  string // empty means the whole host
+	strip   string // removed from path before forwarding, and added back to redirects and cookies
+	handler http.Handler
+}
+
+func (rt *route) key() string {
+	return rt.host + rt.prefix
+}
+
+func (rt *route) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rt.strip == "" {
+		r.Header.Del("X-Forwarded-Prefix") // only trust the one set by us
+		rt.handler.ServeHTTP(w, r)
+		return
+	}
+	if r.URL.Path == rt.strip && (r.Method == "GET" || r.Method == "HEAD") {
+		// relative links in the page only work with a trailing slash
+		target := rt.strip + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = stripPrefix(r.URL.Path, rt.strip)
+	if r.URL.RawPath != "" {
+		r2.URL.RawPath = stripPrefix(r.URL.RawPath, rt.strip)
+	}
+	r2.RequestURI = r2.URL.RequestURI()
+	r2.Header.Set("X-Forwarded-Prefix", rt.strip)
+	rt.handler.ServeHTTP(&prefixResponseWriter{ResponseWriter: w, prefix: rt.strip, host: r.Host}, r2)
+}
+
+// prefixResponseWriter add the stripped prefix back to Location and cookie path
+type prefixResponseWriter struct {
+	http.ResponseWriter
+	prefix      string
+	host        string
+	wroteHeader bool
+}
+
+func (pw *prefixResponseWriter) Unwrap() http.ResponseWriter {
+	return pw.ResponseWriter
+}
+
+func (pw *prefixResponseWriter) WriteHeader(code int) {
+	if !pw.wroteHeader && code >= 200 {
+		pw.wroteHeader = true
+		h := pw.Header()
+		if loc := h.Get("Location"); loc != "" {
+			h.Set("Location", addPrefixToLocation(loc, pw.prefix, pw.host))
+		}
+		cookies := h.Values("Set-Cookie")
+		for i, c := range cookies {
+			cookies[i] = cookiePathRe.ReplaceAllStringFunc(c, func(m string) string {
+				sub := cookiePathRe.FindStringSubmatch(m)
+				if hasPathPrefix(sub[2], pw.prefix) {
+					return m
+				}
+				return sub[1] + pw.prefix + sub[2]
+			})
+		}
+	}
+	pw.ResponseWriter.WriteHeader(code)
+}
+
+func (pw *prefixResponseWriter) Write(b []byte) (int, error) {
+	if !pw.wroteHeader {
+		pw.WriteHeader(http.StatusOK)
+	}
+	return pw.ResponseWriter.Write(b)
+}
+
+var cookiePathRe = regexp.MustCompile(`(?i)(;\s*path=)(/[^;]*)`)
+
+func addPrefixToLocation(loc, prefix, host string) string {
+	u, err := url.Parse(loc)
+	if err != nil || !strings.HasPrefix(u.Path, "/") || hasPathPrefix(u.Path, prefix) {
+		return loc
+	}
+	if u.Host != "" && u.Host != host {
+		return loc
+	}
+	u.Path = prefix + u.Path
+	if u.RawPath != "" {
+		u.RawPath = prefix + u.RawPath
+	}
+	return u.String()
+}
+
+// cleanPrefix make path prefix like /api, root path become empty
+func cleanPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+func stripPrefix(path, prefix string) string {
+	path = strings.TrimPrefix(path, prefix)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// hasPathPrefix match /api and /api/x, but not /apix
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || prefix == "" || path[len(prefix)] == '/'
+}
+
+// router find http tunnel by host and longest path prefix
+type router struct {
+	sync.RWMutex
+	hosts map[string][]*route // sorted by prefix length, longest first
+}
+
+func newRouter() *router {
+	return &router{hosts: make(map[string][]*route)}
+}
+
+// add return false when host and prefix is already taken
+func (rr *router) add(rt *route) bool {
+	rr.Lock()
+	defer rr.Unlock()
+	routes := rr.hosts[rt.host]
+	for _, r := range routes {
+		if r.prefix == rt.prefix {
+			return false
+		}
+	}
+	routes = append(routes, rt)
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].prefix) > len(routes[j].prefix)
+	})
+	rr.hosts[rt.host] = routes
+	return true
+}
+
+func (rr *router) remove(host, prefix string) {
+	rr.Lock()
+	defer rr.Unlock()
+	routes := rr.hosts[host]
+	for i, r := range routes {
+		if r.prefix == prefix {
+			routes = append(routes[:i:i], routes[i+1:]...)
+			break
+		}
+	}
+	if len(routes) == 0 {
+		delete(rr.hosts, host)
+	} else {
+		rr.hosts[host] = routes
+	}
+}
+
+// match try the exact host first, then wildcard hosts from the most specific,
+// ex: a.foo.example.com, *.foo.example.com, *.example.com
+func (rr *router) match(host, path string) *route {
+	rr.RLock()
+	defer rr.RUnlock()
+	for _, r := range rr.hosts[host] {
+		if hasPathPrefix(path, r.prefix) {
+			return r
+		}
+	}
+	for rest := host; ; {
+		i := strings.Index(rest, ".")
+		if i < 0 {
+			return nil
+		}
+		rest = rest[i+1:]
+		for _, r := range rr.hosts["*."+rest] {
+			if hasPathPrefix(path, r.prefix) {
+				return r
+			}
+		}
+	}
+}
+
+// hasHost is true when any route is on host, wildcard routes included
+func (rr *router) hasHost(host string) bool {
+	rr.RLock()
+	defer rr.RUnlock()
+	if len(rr.hosts[host]) > 0 {
+		return true
+	}
+	for rest := host; strings.Contains(rest, "."); {
+		rest = rest[strings.Index(rest, ".")+1:]
+		if len(rr.hosts["*."+rest]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// keys list host and prefix of all routes
+func (rr *router) keys() []string {
+	rr.RLock()
+	defer rr.RUnlock()
+	var keys []string
+	for _, routes := range rr.hosts {
+		for _, r := range routes {
+			keys = append(keys, r.key())
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
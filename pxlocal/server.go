@@ -1,6 +1,8 @@
 package pxlocal
 
 import (
+	"crypto/ed25519"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
@@ -8,7 +10,9 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gobuild/log"
@@ -32,15 +36,28 @@ const (
 	TYPE_MESSAGE
 	TYPE_REMOTEADDR
 	TYPE_IDLE
+	TYPE_EXPIRED
+	TYPE_SHARELINK
+	TYPE_MAINTENANCE
+	TYPE_HEALTH
+	TYPE_CHALLENGE
+	TYPE_SHARE_MINT // client ask for another share link
 )
 
+// how long a closed tunnel is reported as offline instead of not found
+const offlineKeepTime = 24 * time.Hour
+
 var (
 	upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
 	}
-	namedConnection = make(map[string]chan net.Conn, 10)
-	proxyStats      = &ProxyStats{}
+	namedConnection   = make(map[string]chan net.Conn, 10)
+	namedConnectionMu sync.Mutex
+	proxyStats        = &ProxyStats{}
+
+	ErrReverseTimeout = errors.New("timeout waiting for reverse connection (10s)")
+	ErrTunnelClosed   = errors.New("tunnel closed while waiting for reverse connection")
 )
 
 type message struct {
@@ -52,16 +69,26 @@ type webSocketTunnel struct {
 	wsconn *websocket.Conn
 	data   string
 	sync.Mutex
-	index int64
+	maintenance string // html page provided by client
+	unhealthy   atomic.Bool
+	active      atomic.Int64  // reverse connections in use
+	done        chan struct{} // closed when the control connection ends
 }
 
-var freeport = newFreePort(TCP_MIN_PORT, TCP_MAX_PORT)
+var (
+	freeport = newFreePort(TCP_MIN_PORT, TCP_MAX_PORT)
+	connSeq  int64
+)
+
+// nextConnName must be uniq between all tunnels, it is the key of namedConnection
+func nextConnName() string {
+	return strconv.FormatInt(atomic.AddInt64(&connSeq, 1), 10)
+}
 
-func (t *webSocketTunnel) uniqName() string {
+func (t *webSocketTunnel) maintenancePage() string {
 	t.Lock()
 	defer t.Unlock()
-	t.index += 1
-	return fmt.Sprintf("%d", t.index)
+	return t.maintenance
 }
 
 func (t *webSocketTunnel) sendMessage(mType MessageType, text string) error {
@@ -70,13 +97,22 @@ func (t *webSocketTunnel) sendMessage(mType MessageType, text string) error {
 	return t.wsconn.WriteJSON(&message{Type: mType, Body: text})
 }
 
+// RequestNewConn ask client for a reverse connection, the request carries a random token,
+// so only the client of this tunnel can answer it
 func (t *webSocketTunnel) RequestNewConn(remoteAddr string) (net.Conn, error) {
-	connC := make(chan net.Conn)
-	namedConnection[remoteAddr] = connC
-	defer delete(namedConnection, remoteAddr)
+	connC := make(chan net.Conn, 1)
+	key := remoteAddr + " " + randomToken()
+	namedConnectionMu.Lock()
+	namedConnection[key] = connC
+	namedConnectionMu.Unlock()
+	defer func() {
+		namedConnectionMu.Lock()
+		delete(namedConnection, key)
+		namedConnectionMu.Unlock()
+	}()
 
 	// request a reverse connection
-	if err := t.sendMessage(TYPE_NEWCONN, remoteAddr); err != nil {
+	if err := t.sendMessage(TYPE_NEWCONN, key); err != nil {
 		return nil, fmt.Errorf("failed to send connection request: %v", err)
 	}
 
@@ -87,32 +123,26 @@ func (t *webSocketTunnel) RequestNewConn(remoteAddr string) (net.Conn, error) {
 		}
 		log.Debugf("Established new connection for %s", remoteAddr)
 		return lconn, nil
+	case <-t.done:
+		return nil, ErrTunnelClosed
 	case <-time.After(10 * time.Second):
-		return nil, errors.New("timeout waiting for reverse connection (10s)")
-	}
-}
-
-// used for httputil reverse proxy
-func (t *webSocketTunnel) generateTransportDial() func(network, addr string) (net.Conn, error) {
-	return func(network, addr string) (net.Conn, error) {
-		log.Println("transport", network, addr)
-		return t.RequestNewConn(t.uniqName())
+		return nil, ErrReverseTimeout
 	}
 }
 
-// Listen and forward connections
-func newTcpProxyListener(tunnel *webSocketTunnel, port int) (listener *net.TCPListener, err error) {
-	var laddr *net.TCPAddr
+// listenPort listen the request port, 0 means a free port from pool
+func listenPort(port int) (laddr *net.TCPAddr, listener *net.TCPListener, err error) {
 	if port != 0 {
 		laddr, _ = net.ResolveTCPAddr("tcp", ":"+strconv.Itoa(port))
 		listener, err = net.ListenTCP("tcp", laddr)
-	} else {
-		laddr, listener, err = freeport.ListenTCP()
-	}
-	if err != nil {
-		return nil, err
+		return
 	}
-	port = laddr.Port
+	return freeport.ListenTCP()
+}
+
+// Forward connections of listener to members of group, listener is closed when hook fails
+func newTcpProxyListener(group *tunnelGroup, tunnel *webSocketTunnel, listener *net.TCPListener) (err error) {
+	port := listener.Addr().(*net.TCPAddr).Port
 	// hook here
 	err = hook(HOOK_TCP_POST_CONNECT, []string{
 		"PORT=" + strconv.Itoa(port),
@@ -122,7 +152,7 @@ func newTcpProxyListener(tunnel *webSocketTunnel, port int) (listener *net.TCPLi
 	})
 	if err != nil {
 		listener.Close()
-		return
+		return err
 	}
 
 	go func() {
@@ -134,7 +164,12 @@ func newTcpProxyListener(tunnel *webSocketTunnel, port int) (listener *net.TCPLi
 			}
 			// find proxy to where
 			log.Debug("Receive new connections from", rconn.RemoteAddr())
-			lconn, err := tunnel.RequestNewConn(rconn.RemoteAddr().String())
+			if !group.healthy() {
+				log.Debug("local service is down, reject", rconn.RemoteAddr())
+				rconn.Close()
+				continue
+			}
+			lconn, err := group.RequestNewConn(rconn.RemoteAddr().String())
 			if err != nil {
 				log.Debug("request new conn err:", err)
 				rconn.Close()
@@ -150,7 +185,7 @@ func newTcpProxyListener(tunnel *webSocketTunnel, port int) (listener *net.TCPLi
 			go pc.start()
 		}
 	}()
-	return listener, nil
+	return nil
 }
 
 type RequestInfo struct {
@@ -158,6 +193,31 @@ type RequestInfo struct {
 	Subdomain string
 	Port      int
 	Data      string
+	TTL       time.Duration
+	ShareTTL  time.Duration
+	ShareOnce bool
+	Group     string // clients with the same group key share one address
+	LB        string // load balance strategy of group
+	Path      string // path prefix of http tunnel
+	StripPath bool
+	// http tunnel on a dedicated port instead of subdomain
+	PortTunnel bool
+	Wildcard   bool     // also claim *.<subdomain>.<domain>
+	Hostnames  []string // custom hostnames, routed after verified
+	Domain     string   // base domain, empty means the default one
+	Token      string   // checked by access policy of the domain
+	UserToken  string   // user in the users file of subdomain policy
+	PublicKey  string   // ed25519 identity key of client, verified by challenge
+	Private    string   // name of tcp tunnel only reachable by visitor clients
+}
+
+func formSeconds(r *http.Request, key string) time.Duration {
+	var sec int
+	fmt.Sscanf(r.FormValue(key), "%d", &sec)
+	if sec <= 0 {
+		return 0
+	}
+	return time.Duration(sec) * time.Second
 }
 
 func parseConnectRequest(r *http.Request) RequestInfo {
@@ -182,6 +242,22 @@ func parseConnectRequest(r *http.Request) RequestInfo {
 		Subdomain: subdomain,
 		Port:      port,
 		Data:      r.FormValue("data"),
+		TTL:       formSeconds(r, "ttl"),
+		ShareTTL:  formSeconds(r, "share_ttl"),
+		ShareOnce: r.FormValue("share_once") == "1",
+		Group:     r.FormValue("group"),
+		LB:        r.FormValue("lb"),
+		Path:      cleanPrefix(r.FormValue("path")),
+		StripPath: r.FormValue("strip_path") == "1",
+
+		PortTunnel: r.FormValue("port_tunnel") == "1",
+		Wildcard:   r.FormValue("wildcard") == "1",
+		Hostnames:  r.Form["hostname"],
+		Domain:     r.FormValue("domain"),
+		Token:      r.FormValue("token"),
+		UserToken:  r.FormValue("user_token"),
+		PublicKey:  r.FormValue("pubkey"),
+		Private:    r.FormValue("private"),
 	}
 }
 
@@ -192,7 +268,8 @@ func wsProxyHandler(w http.ResponseWriter, r *http.Request) {
 		log.Warnf("Invalid request: missing X-Proxy-For header, remoteAddr: %s", r.RemoteAddr)
 		return
 	}
-	log.Infof("wshijack proxyFor: %s", proxyFor)
+	addr, _, _ := strings.Cut(proxyFor, " ") // the token is not logged
+	log.Infof("wshijack proxyFor: %s", addr)
 
 	wsConn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -202,19 +279,114 @@ func wsProxyHandler(w http.ResponseWriter, r *http.Request) {
 	// defer wsConn.Close() // keep it open for hijack
 	log.Debug("remote client addr:", wsConn.RemoteAddr())
 
+	namedConnectionMu.Lock()
 	connC, ok := namedConnection[proxyFor]
+	namedConnectionMu.Unlock()
 	if !ok {
-		log.Warnf("No proxy connection waiting for %s", proxyFor)
+		log.Warnf("No proxy connection waiting for %s", addr)
+		wsConn.Close()
 		return
 	}
-	connC <- wsConn.NetConn()
+	select {
+	case connC <- wsConn.NetConn():
+	default: // already answered
+		wsConn.Close()
+	}
+}
+
+type offlineTunnel struct {
+	since       time.Time
+	maintenance string
 }
 
 type ProxyServer struct {
-	domain string
+	domain  string // default base domain
+	domains map[string]*baseDomain
 	*http.ServeMux
-	revProxies map[string]*httputil.ReverseProxy
+	routes        *router
+	httpGroups    map[string]*tunnelGroup // key is host and path prefix
+	portGroups    map[int]*tunnelGroup    // tcp and http tunnels on dedicated ports
+	reservedPorts map[int]bool            // picked from ranges of authorized keys, not bound yet
+	privateGroups map[string]*tunnelGroup // end to end encrypted tcp tunnels, key is the name
+	offline       map[string]offlineTunnel
 	sync.RWMutex
+
+	// forwarding headers from these proxies are kept and appended to, others are replaced
+	TrustedProxies []*net.IPNet
+
+	ErrorPages *ErrorPages // nil means use builtin pages
+
+	// expose http tunnels at http://host/t/<name>/, used when there is no wildcard dns
+	PathTunnels bool
+
+	Policy *SubdomainPolicy // decide which subdomains a client may claim
+
+	AuthorizedKeys *AuthorizedKeys // nil means identity keys are optional
+
+	// require client certificates signed by these CAs for control and reverse connections,
+	// name in certificate is the identity of client
+	ClientCAs *x509.CertPool
+
+	lookupTXT func(name string) ([]string, error) // verify custom hostnames, nil means net.LookupTXT
+}
+
+const pathTunnelPrefix = "/t/"
+
+func (ps *ProxyServer) newProxyErrorHandler(group *tunnelGroup) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Warnf("Proxy error for %s: %v", r.URL, err)
+		kind := ERROR_PAGE_OFFLINE
+		var localErr *localServiceError
+		switch {
+		case errors.As(err, &localErr):
+			kind = localErr.kind
+		case errors.Is(err, ErrReverseTimeout):
+			kind = ERROR_PAGE_TIMEOUT
+		}
+		ps.ErrorPages.render(w, r, kind, errorPageData{Domain: ps.pageDomain(r), Error: err.Error()}, group.maintenancePage())
+	}
+}
+
+// pageDomain is the base domain of request host used in error pages,
+// a custom hostname is its own domain
+func (ps *ProxyServer) pageDomain(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if d := ps.baseDomainOf(host); d != nil {
+		return d.Name
+	}
+	return host
+}
+
+// serveNoTunnel render not found or offline page for proxy subdomains
+func (ps *ProxyServer) serveNoTunnel(w http.ResponseWriter, r *http.Request) bool {
+	if d := ps.baseDomainOf(r.Host); (d == nil || d.Name == r.Host) &&
+		!(ps.PathTunnels && strings.HasPrefix(r.URL.Path, pathTunnelPrefix)) {
+		return false
+	}
+	host := ps.routeHost(r)
+	ps.RLock()
+	var off offlineTunnel
+	var wasOnline bool
+	// longest prefix of offline routes on this host
+	prefixLen := -1
+	for key, o := range ps.offline {
+		prefix, ok := strings.CutPrefix(key, host)
+		if ok && len(prefix) > prefixLen && hasPathPrefix(r.URL.Path, prefix) {
+			off, wasOnline, prefixLen = o, true, len(prefix)
+		}
+	}
+	ps.RUnlock()
+	data := errorPageData{Domain: ps.pageDomain(r)}
+	if wasOnline && time.Since(off.since) < offlineKeepTime {
+		ps.ErrorPages.render(w, r, ERROR_PAGE_OFFLINE, data, off.maintenance)
+	} else {
+		ps.ErrorPages.render(w, r, ERROR_PAGE_NOT_FOUND, data, "")
+	}
+	return true
 }
 
 func (ps *ProxyServer) newHomepageHandler() func(w http.ResponseWriter, r *http.Request) {
@@ -224,19 +396,166 @@ func (ps *ProxyServer) newHomepageHandler() func(w http.ResponseWriter, r *http.
 			proxyStats.receivedBytes, proxyStats.sentBytes))
 		io.WriteString(w, "<b>HTTP:</b> ...<br>")
 		io.WriteString(w, "<hr>")
-		for pname, _ := range ps.revProxies {
+		for _, pname := range ps.routes.keys() {
 			io.WriteString(w, fmt.Sprintf("http proxy: %s <br>", pname))
 		}
 	}
 }
 
+func (ps *ProxyServer) newHTTPProxy(group *tunnelGroup) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		FlushInterval: -1, // flush immediately, required by server-sent events
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			log.Println("rewrite:", pr.In.RequestURI)
+			pr.Out.URL.Scheme, pr.Out.URL.Host = "http", pr.In.Host // dial is done by tunnel
+			trusted := fromTrustedProxy(pr.In, ps.TrustedProxies)
+			if trusted {
+				// SetXForwarded appends to the chain of the proxy in front
+				pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+			}
+			pr.SetXForwarded()
+			setForwarded(pr.Out, pr.In, trusted)
+		},
+		Transport: group,
+		ModifyResponse: func(resp *http.Response) error {
+			kind := resp.Header.Get(headerProxylocalError)
+			resp.Header.Del(headerProxylocalError)
+			switch kind {
+			case ERROR_PAGE_REFUSED, ERROR_PAGE_LOCAL_TIMEOUT, ERROR_PAGE_BAD_GATEWAY:
+				resp.Body.Close()
+				return &localServiceError{kind: kind}
+			}
+			return nil
+		},
+		ErrorHandler: ps.newProxyErrorHandler(group),
+	}
+}
+
+// newGroupHandler serve visitors of http group
+func (ps *ProxyServer) newGroupHandler(group *tunnelGroup, reqInfo RequestInfo) http.Handler {
+	revProxy := ps.newHTTPProxy(group)
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !group.healthy() {
+			ps.ErrorPages.render(w, r, ERROR_PAGE_UNAVAILABLE, errorPageData{Domain: ps.pageDomain(r)}, group.maintenancePage())
+			return
+		}
+		revProxy.ServeHTTP(w, r)
+	})
+	if reqInfo.ShareTTL > 0 || reqInfo.ShareOnce {
+		group.guard = newShareGuard(handler)
+		handler = group.guard
+	}
+	return handler
+}
+
+// joinHTTPGroup register tunnel on host and path prefix of rt, false means it is taken.
+// host is the subdomain claimed, other prefixes of it are only added with the same group key
+func (ps *ProxyServer) joinHTTPGroup(rt *route, host string, tunnel *webSocketTunnel, reqInfo RequestInfo) (*tunnelGroup, bool) {
+	ps.Lock()
+	defer ps.Unlock()
+	if group, exists := ps.httpGroups[rt.key()]; exists {
+		return group, group.join(tunnel, reqInfo.Protocol, reqInfo.Group)
+	}
+	for _, other := range ps.httpGroups {
+		if other.host == host && !other.sameKey(reqInfo.Group) {
+			return nil, false
+		}
+	}
+	group := newTunnelGroup(reqInfo.Protocol, reqInfo.Group, reqInfo.LB)
+	group.host = host
+	group.join(tunnel, reqInfo.Protocol, reqInfo.Group)
+	group.handler = ps.newGroupHandler(group, reqInfo)
+	rt.handler = group.handler
+	if !ps.routes.add(rt) {
+		return group, false
+	}
+	ps.httpGroups[rt.key()] = group
+	delete(ps.offline, rt.key())
+	return group, true
+}
+
+func (ps *ProxyServer) leaveHTTPGroup(rt *route, group *tunnelGroup, tunnel *webSocketTunnel) {
+	maintenance := group.maintenancePage()
+	ps.Lock()
+	defer ps.Unlock()
+	if !group.leave(tunnel) {
+		return
+	}
+	if group.guard != nil {
+		group.guard.Close()
+	}
+	ps.routes.remove(rt.host, rt.prefix)
+	for _, alias := range group.aliases {
+		ps.routes.remove(alias.host, alias.prefix)
+	}
+	delete(ps.httpGroups, rt.key())
+	for key, off := range ps.offline {
+		if time.Since(off.since) > offlineKeepTime {
+			delete(ps.offline, key)
+		}
+	}
+	ps.offline[rt.key()] = offlineTunnel{since: time.Now(), maintenance: maintenance}
+}
+
+// joinPortGroup listen a new port or join the group on the request port,
+// reqInfo.Port is updated to the real listen port
+func (ps *ProxyServer) joinPortGroup(tunnel *webSocketTunnel, reqInfo *RequestInfo) (*tunnelGroup, error) {
+	ps.Lock()
+	defer ps.Unlock()
+	if group, exists := ps.portGroups[reqInfo.Port]; exists && reqInfo.Port != 0 {
+		if !group.join(tunnel, reqInfo.Protocol, reqInfo.Group) {
+			return nil, fmt.Errorf("port %d has already been taken", reqInfo.Port)
+		}
+		return group, nil
+	}
+	_, listener, err := listenPort(reqInfo.Port)
+	if err != nil {
+		return nil, err
+	}
+	return ps.servePortGroup(tunnel, reqInfo, listener)
+}
+
+// servePortGroup start a new group on listener, ps must be locked
+func (ps *ProxyServer) servePortGroup(tunnel *webSocketTunnel, reqInfo *RequestInfo, listener *net.TCPListener) (*tunnelGroup, error) {
+	group := newTunnelGroup(reqInfo.Protocol, reqInfo.Group, reqInfo.LB)
+	group.join(tunnel, reqInfo.Protocol, reqInfo.Group)
+	if reqInfo.Protocol == "tcp" {
+		if err := newTcpProxyListener(group, tunnel, listener); err != nil {
+			return nil, err
+		}
+	} else {
+		// a real http proxy on the port, not a raw tcp pipe
+		group.server = &http.Server{Handler: ps.newGroupHandler(group, *reqInfo), Protocols: ServerProtocols()}
+		go group.server.Serve(listener)
+	}
+	group.listener = listener
+	reqInfo.Port = listener.Addr().(*net.TCPAddr).Port
+	ps.portGroups[reqInfo.Port] = group
+	return group, nil
+}
+
+func (ps *ProxyServer) leavePortGroup(group *tunnelGroup, tunnel *webSocketTunnel, port int) {
+	ps.Lock()
+	defer ps.Unlock()
+	if group.leave(tunnel) {
+		if group.guard != nil {
+			group.guard.Close()
+		}
+		if group.server != nil {
+			group.server.Close()
+		}
+		group.listener.Close()
+		delete(ps.portGroups, port)
+	}
+}
+
 func (ps *ProxyServer) newControlHandler() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// read listen port from request
 		//protocol, subdomain, port
 		reqInfo := parseConnectRequest(r)
-		log.Debugf("proxy listen proto: %v, subdomain: %v port: %v",
-			reqInfo.Protocol, reqInfo.Subdomain, reqInfo.Port)
+		log.Debugf("proxy listen proto: %v, subdomain: %v port: %v ttl: %v",
+			reqInfo.Protocol, reqInfo.Subdomain, reqInfo.Port, reqInfo.TTL)
 
 		// create websocket connection
 		conn, err := upgrader.Upgrade(w, r, nil)
@@ -250,64 +569,187 @@ func (ps *ProxyServer) newControlHandler() func(w http.ResponseWriter, r *http.R
 		tunnel := &webSocketTunnel{
 			wsconn: conn,
 			data:   reqInfo.Data,
+			done:   make(chan struct{}),
+		}
+		defer close(tunnel.done) // pending reverse connection requests give up
+		domain, err := ps.lookupDomain(reqInfo.Domain)
+		if err == nil {
+			err = domain.allow(reqInfo.Protocol, reqInfo.Token)
 		}
+		var certID *Identity
+		if err == nil && ps.ClientCAs != nil {
+			certID, err = ps.certIdentity(r)
+		}
+		var pubKey ed25519.PublicKey
+		if err == nil && reqInfo.PublicKey != "" {
+			if pubKey, err = decodePublicKey(reqInfo.PublicKey); err == nil {
+				err = tunnel.verifyIdentity(pubKey, r.Host)
+			}
+		}
+		var authKey *authorizedKey
+		if err == nil && ps.AuthorizedKeys != nil {
+			if pubKey == nil {
+				err = ErrKeyNotAuthorized
+			} else if authKey, err = ps.AuthorizedKeys.lookup(pubKey); err == nil {
+				err = authKey.allowProtocol(reqInfo.Protocol)
+			}
+			if err == nil {
+				var release func()
+				if release, err = ps.AuthorizedKeys.acquire(pubKey, authKey); err == nil {
+					defer release()
+				}
+			}
+		}
+		if err != nil {
+			log.Warnf("reject %v: %v", conn.RemoteAddr(), err)
+			tunnel.sendMessage(TYPE_MESSAGE, err.Error())
+			return
+		}
+		// set by http tunnels with share links, used to mint more links later
+		var shareGuard *shareGuard
+		var shareScheme, shareHost string
 		// TCP: create new port to listen
 		log.Infof("New %s proxy for %v", reqInfo.Protocol, conn.RemoteAddr())
 		switch reqInfo.Protocol {
 		case "tcp":
-			listener, err := newTcpProxyListener(tunnel, reqInfo.Port)
+			if reqInfo.Private != "" {
+				if authKey != nil && authKey.identity != nil && !authKey.identity.allowed(reqInfo.Private) {
+					err := fmt.Errorf("%w: private name %s, allowed %s", ErrKeyRestricted, reqInfo.Private, authKey.identity.patterns())
+					log.Warnf("reject %v: %v", conn.RemoteAddr(), err)
+					tunnel.sendMessage(TYPE_MESSAGE, err.Error())
+					return
+				}
+				group, err := ps.joinPrivateGroup(tunnel, reqInfo)
+				if err != nil {
+					log.Warnf("new private proxy err: %v", err)
+					tunnel.sendMessage(TYPE_MESSAGE, err.Error())
+					return
+				}
+				defer ps.leavePrivateGroup(reqInfo.Private, group, tunnel)
+				tunnel.sendMessage(TYPE_REMOTEADDR, "private:"+reqInfo.Private)
+				break
+			}
+			group, err := ps.joinAllowedPort(tunnel, &reqInfo, authKey)
 			if err != nil {
 				log.Warnf("new tcp proxy err: %v", err)
-				http.Error(w, err.Error(), 501)
+				tunnel.sendMessage(TYPE_MESSAGE, err.Error())
 				return
 			}
-			defer listener.Close()
-			_, port, _ := net.SplitHostPort(listener.Addr().String())
-			tunnel.sendMessage(TYPE_REMOTEADDR, fmt.Sprintf("%s:%v", ps.domain, port))
-		case "http", "https":
-			tr := &http.Transport{
-				Dial: tunnel.generateTransportDial(),
-			}
-			revProxy := &httputil.ReverseProxy{
-				Director: func(req *http.Request) {
-					log.Println("director:", req.RequestURI)
-				},
-				Transport: tr,
-				ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
-					log.Warnf("Proxy error for %s: %v", r.URL, err)
-					if err.Error() == "EOF" {
-						http.Error(w, "Backend connection closed unexpectedly", http.StatusBadGateway)
-					} else {
-						http.Error(w, "Proxy error: "+err.Error(), http.StatusBadGateway)
-					}
-				},
+			defer ps.leavePortGroup(group, tunnel, reqInfo.Port)
+			tunnel.sendMessage(TYPE_REMOTEADDR, fmt.Sprintf("%s:%v", domain.Name, reqInfo.Port))
+		case "http", "https", "http2":
+			if reqInfo.PortTunnel {
+				group, err := ps.joinAllowedPort(tunnel, &reqInfo, authKey)
+				if err != nil {
+					log.Warnf("new http port proxy err: %v", err)
+					tunnel.sendMessage(TYPE_MESSAGE, err.Error())
+					return
+				}
+				defer ps.leavePortGroup(group, tunnel, reqInfo.Port)
+				pxAddr := fmt.Sprintf("%s:%v", domain.Name, reqInfo.Port)
+				tunnel.sendMessage(TYPE_REMOTEADDR, pxAddr)
+				shareScheme, shareHost = "http", pxAddr
+				if group.guard != nil && (reqInfo.ShareTTL > 0 || reqInfo.ShareOnce) {
+					token := group.guard.mint(reqInfo.ShareTTL, reqInfo.ShareOnce)
+					tunnel.sendMessage(TYPE_SHARELINK, shareURL(shareScheme, shareHost, token))
+				}
+				shareGuard = group.guard
+				break
 			}
 			// should hook here
 			// hook(HOOK_CREATE_HTTP_SUBDOMAIN, subdomain)
 			// generate a uniq domain
-			if reqInfo.Subdomain == "" {
-				reqInfo.Subdomain = uniqName(5)
+			identity := ps.Policy.identify(reqInfo.UserToken)
+			if certID != nil {
+				identity = certID
+			}
+			if authKey != nil && authKey.identity != nil {
+				identity = authKey.identity
+			}
+			if reqInfo.Subdomain == "" && pubKey != nil && identity == nil {
+				reqInfo.Subdomain = keySubdomain(pubKey) // stable between connections
+			} else if reqInfo.Subdomain == "" {
+				var release func()
+				var err error
+				if reqInfo.Subdomain, release, err = ps.Policy.randomName(identity); err != nil {
+					log.Warnf("reject %v: %v", conn.RemoteAddr(), err)
+					tunnel.sendMessage(TYPE_MESSAGE, err.Error())
+					return
+				}
+				defer release()
+			} else {
+				reqInfo.Subdomain = strings.ToLower(reqInfo.Subdomain)
+				err := ps.Policy.check(reqInfo.Subdomain, identity)
+				if err == nil && isKeySubdomain(reqInfo.Subdomain) && (pubKey == nil || keySubdomain(pubKey) != reqInfo.Subdomain) {
+					err = fmt.Errorf("%w: %s belongs to another key", ErrSubdomainReserved, reqInfo.Subdomain)
+				}
+				if err != nil {
+					log.Warnf("reject %v: %v", conn.RemoteAddr(), err)
+					tunnel.sendMessage(TYPE_MESSAGE, err.Error())
+					return
+				}
 			}
-			pxDomain := reqInfo.Subdomain + "." + ps.domain
-			log.Println("http px use domain:", pxDomain)
-			if _, exists := ps.revProxies[pxDomain]; exists {
-				tunnel.sendMessage(TYPE_MESSAGE, fmt.Sprintf("subdomain [%s] has already been taken", pxDomain))
+			pxDomain := reqInfo.Subdomain + "." + domain.Name
+			rt := &route{host: pxDomain, prefix: reqInfo.Path}
+			if reqInfo.StripPath {
+				rt.strip = rt.prefix
+			}
+			pxAddr := rt.key()
+			if ps.PathTunnels {
+				// visitors use the base domain, ex: example.com/t/name/
+				rt.host = domain.Name
+				rt.prefix = pathTunnelPrefix + reqInfo.Subdomain + reqInfo.Path
+				rt.strip = pathTunnelPrefix + reqInfo.Subdomain
+				if reqInfo.StripPath {
+					rt.strip = rt.prefix
+				}
+			}
+			log.Println("http px use domain:", rt.key())
+			group, ok := ps.joinHTTPGroup(rt, pxDomain, tunnel, reqInfo)
+			if !ok {
+				tunnel.sendMessage(TYPE_MESSAGE, fmt.Sprintf("subdomain [%s] has already been taken", rt.key()))
 				return
 			}
-			ps.Lock()
-			ps.revProxies[pxDomain] = revProxy
-			ps.Unlock()
-			tunnel.sendMessage(TYPE_REMOTEADDR, pxDomain)
-
-			defer func() {
-				ps.Lock()
-				delete(ps.revProxies, pxDomain)
-				ps.Unlock()
-			}()
+			if ps.PathTunnels {
+				// keep the port client dialed, the server listens there
+				pxAddr = rt.key()
+				if _, port, err := net.SplitHostPort(r.Host); err == nil {
+					pxAddr = net.JoinHostPort(rt.host, port) + rt.prefix
+				}
+				tunnel.sendMessage(TYPE_REMOTEADDR, pxAddr+"/")
+			} else {
+				tunnel.sendMessage(TYPE_REMOTEADDR, pxAddr)
+			}
+			shareScheme, shareHost = requestScheme(r), pxAddr
+			if group.guard != nil && (reqInfo.ShareTTL > 0 || reqInfo.ShareOnce) {
+				token := group.guard.mint(reqInfo.ShareTTL, reqInfo.ShareOnce)
+				tunnel.sendMessage(TYPE_SHARELINK, shareURL(shareScheme, shareHost, token))
+			}
+			shareGuard = group.guard
+			defer ps.leaveHTTPGroup(rt, group, tunnel)
+			var aliases []string
+			if reqInfo.Wildcard && !ps.PathTunnels {
+				aliases = append(aliases, "*."+pxDomain)
+			}
+			if len(reqInfo.Hostnames) > 0 && authKey != nil && authKey.identity != nil {
+				// the key may only claim its subdomains
+				tunnel.sendMessage(TYPE_MESSAGE, fmt.Sprintf("%v: custom hostnames, allowed %s", ErrKeyRestricted, authKey.identity.patterns()))
+			} else if len(reqInfo.Hostnames) > 0 {
+				aliases = append(aliases, ps.customHostnames(reqInfo.Hostnames, pubKey, tunnel)...)
+			}
+			ps.addAliases(rt, group, aliases, tunnel)
 		default:
 			log.Warn("unknown protocol:", reqInfo.Protocol)
 			return
 		}
+		if reqInfo.TTL > 0 {
+			timer := time.AfterFunc(reqInfo.TTL, func() {
+				log.Infof("Tunnel for %v expired after %v", conn.RemoteAddr(), reqInfo.TTL)
+				tunnel.sendMessage(TYPE_EXPIRED, reqInfo.TTL.String())
+				conn.Close()
+			})
+			defer timer.Stop()
+		}
 		// HTTP: use httputil.ReverseProxy
 		// Keep connection alive by reading messages
 		for {
@@ -317,6 +759,23 @@ func (ps *ProxyServer) newControlHandler() func(w http.ResponseWriter, r *http.R
 				break
 			}
 			log.Debug("recv json:", msg)
+			switch msg.Type {
+			case TYPE_MAINTENANCE:
+				if len(msg.Body) <= maxMaintenancePage {
+					tunnel.Lock()
+					tunnel.maintenance = msg.Body
+					tunnel.Unlock()
+				}
+			case TYPE_HEALTH:
+				tunnel.unhealthy.Store(msg.Body != healthUp)
+			case TYPE_SHARE_MINT:
+				if shareGuard == nil {
+					tunnel.sendMessage(TYPE_SHARELINK, "") // share links are not enabled
+					break
+				}
+				ttl, once := parseShareMint(msg.Body)
+				tunnel.sendMessage(TYPE_SHARELINK, shareURL(shareScheme, shareHost, shareGuard.mint(ttl, once)))
+			}
 		}
 	}
 }
@@ -326,30 +785,57 @@ func (p *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	r.URL.Scheme = "http" // ??
 	r.URL.Host = r.Host   // ??
 	log.Debug("URL path:", r.URL.Path)
-	log.Debugf("proxy lists: %v", p.revProxies)
-	if rpx, ok := p.revProxies[r.Host]; ok {
-		log.Debugf("server httpRevProxy for %s", r.Host)
-		rpx.ServeHTTP(w, r)
+	if rt := p.routes.match(p.routeHost(r), r.URL.Path); rt != nil {
+		log.Debugf("server httpRevProxy for %s", rt.key())
+		rt.ServeHTTP(w, r)
+		return
+	}
+	if p.serveNoTunnel(w, r) {
 		return
 	}
 	h, _ := p.Handler(r)
 	h.ServeHTTP(w, r)
 }
 
+// routeHost is the host routes are matched on, path tunnels are on base domains without port
+func (p *ProxyServer) routeHost(r *http.Request) string {
+	if !p.PathTunnels || !strings.HasPrefix(r.URL.Path, pathTunnelPrefix) {
+		return r.Host
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if d := p.baseDomainOf(host); d != nil && d.Name == host {
+		return host
+	}
+	return r.Host
+}
+
 // domain, ex shengxiang.me
 // dns should set *.shengxiang.me
 func NewProxyServer(domain string) *ProxyServer {
+	domain = strings.ToLower(domain)
 	if domain == "" {
 		domain = "localhost"
 	}
 	p := &ProxyServer{
-		domain:     domain,
-		ServeMux:   http.NewServeMux(),
-		revProxies: make(map[string]*httputil.ReverseProxy),
+		domain:        domain,
+		domains:       map[string]*baseDomain{domain: {DomainConfig: DomainConfig{Name: domain}}},
+		ServeMux:      http.NewServeMux(),
+		routes:        newRouter(),
+		Policy:        NewSubdomainPolicy(),
+		httpGroups:    make(map[string]*tunnelGroup),
+		portGroups:    make(map[int]*tunnelGroup),
+		reservedPorts: make(map[int]bool),
+		privateGroups: make(map[string]*tunnelGroup),
+		offline:       make(map[string]offlineTunnel),
 	}
 	p.HandleFunc("/", p.newHomepageHandler())
-	p.HandleFunc("/ws", p.newControlHandler())
-	p.HandleFunc("/ws/reverse", wsProxyHandler)
+	p.HandleFunc("/ws", p.requireClientCert(p.newControlHandler()))
+	p.HandleFunc("/ws/reverse", p.requireClientCert(wsProxyHandler))
+	p.HandleFunc("/ws/visit", p.requireClientCert(p.visitHandler))
 
 	return p
 }
@@ -0,0 +1,195 @@
+package pxlocal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	shareTokenParam    = "pxl_token"
+	shareSessionCookie = "pxl_session"
+	shareSweepInterval = time.Minute
+)
+
+type shareToken struct {
+	expires time.Time // zero means valid as long as the tunnel lives
+	once    bool
+}
+
+func (t *shareToken) expired() bool {
+	return !t.expires.IsZero() && time.Now().After(t.expires)
+}
+
+// shareGuard only lets visitors through who opened a share link,
+// the token in the link is exchanged for a session cookie.
+type shareGuard struct {
+	sync.Mutex
+	tokens   map[string]*shareToken
+	sessions map[string]time.Time
+	handler  http.Handler
+	done     chan struct{}
+	closed   sync.Once
+}
+
+func newShareGuard(h http.Handler) *shareGuard {
+	g := &shareGuard{
+		tokens:   make(map[string]*shareToken),
+		sessions: make(map[string]time.Time),
+		handler:  h,
+		done:     make(chan struct{}),
+	}
+	go g.sweepLoop(shareSweepInterval)
+	return g
+}
+
+// Close stop the sweep, called when the tunnel group is gone
+func (g *shareGuard) Close() {
+	g.closed.Do(func() { close(g.done) })
+}
+
+func (g *shareGuard) sweepLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-ticker.C:
+			g.sweep()
+		}
+	}
+}
+
+// sweep remove expired tokens and sessions, which are never looked up again
+func (g *shareGuard) sweep() {
+	g.Lock()
+	defer g.Unlock()
+	now := time.Now()
+	for token, st := range g.tokens {
+		if st.expired() {
+			delete(g.tokens, token)
+		}
+	}
+	for session, expires := range g.sessions {
+		if !expires.IsZero() && now.After(expires) {
+			delete(g.sessions, session)
+		}
+	}
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func shareURL(scheme, host, token string) string {
+	return scheme + "://" + host + "/?" + shareTokenParam + "=" + token
+}
+
+// parseShareMint read ttl in seconds and once from body of TYPE_SHARE_MINT
+func parseShareMint(body string) (ttl time.Duration, once bool) {
+	q, _ := url.ParseQuery(body)
+	sec, _ := strconv.Atoi(q.Get("ttl"))
+	return time.Duration(sec) * time.Second, q.Get("once") == "1"
+}
+
+// mint create a new access token, ttl 0 means no time limit
+func (g *shareGuard) mint(ttl time.Duration, once bool) string {
+	g.Lock()
+	defer g.Unlock()
+	token := randomToken()
+	st := &shareToken{once: once}
+	if ttl > 0 {
+		st.expires = time.Now().Add(ttl)
+	}
+	g.tokens[token] = st
+	return token
+}
+
+// redeem exchange the token for a session id
+func (g *shareGuard) redeem(token string) (session string, expires time.Time, ok bool) {
+	g.Lock()
+	defer g.Unlock()
+	st, exists := g.tokens[token]
+	if !exists {
+		return "", expires, false
+	}
+	if st.expired() {
+		delete(g.tokens, token)
+		return "", expires, false
+	}
+	if st.once {
+		delete(g.tokens, token)
+	}
+	session = randomToken()
+	g.sessions[session] = st.expires
+	return session, st.expires, true
+}
+
+func (g *shareGuard) validSession(session string) bool {
+	g.Lock()
+	defer g.Unlock()
+	expires, ok := g.sessions[session]
+	if !ok {
+		return false
+	}
+	if !expires.IsZero() && time.Now().After(expires) {
+		delete(g.sessions, session)
+		return false
+	}
+	return true
+}
+
+// stripSessionCookie remove our own cookie, local service should not see it
+func stripSessionCookie(r *http.Request) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	var kept []string
+	for _, c := range cookies {
+		if c.Name != shareSessionCookie {
+			kept = append(kept, c.String())
+		}
+	}
+	if len(kept) > 0 {
+		r.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
+
+func (g *shareGuard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if token := r.URL.Query().Get(shareTokenParam); token != "" {
+		session, expires, ok := g.redeem(token)
+		if !ok {
+			http.Error(w, "Share link is invalid or has expired", http.StatusForbidden)
+			return
+		}
+		cookie := &http.Cookie{
+			Name:     shareSessionCookie,
+			Value:    session,
+			Path:     "/",
+			HttpOnly: true,
+			Expires:  expires,
+		}
+		http.SetCookie(w, cookie)
+		u := *r.URL
+		q := u.Query()
+		q.Del(shareTokenParam)
+		u.RawQuery = q.Encode()
+		u.Scheme, u.Host = "", ""
+		http.Redirect(w, r, u.String(), http.StatusFound)
+		return
+	}
+	c, err := r.Cookie(shareSessionCookie)
+	if err != nil || !g.validSession(c.Value) {
+		http.Error(w, "A valid share link is required to access this tunnel", http.StatusForbidden)
+		return
+	}
+	stripSessionCookie(r)
+	g.handler.ServeHTTP(w, r)
+}
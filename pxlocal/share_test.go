@@ -0,0 +1,99 @@
+package pxlocal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestShareGuard(t *testing.T) {
+	g := newShareGuard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie(shareSessionCookie); err == nil {
+			t.Error("session cookie should not reach local service")
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer g.Close()
+
+	Convey("Redeem tokens for sessions", t, func() {
+		token := g.mint(0, false)
+		session, expires, ok := g.redeem(token)
+		So(ok, ShouldBeTrue)
+		So(expires.IsZero(), ShouldBeTrue)
+		So(g.validSession(session), ShouldBeTrue)
+		So(g.validSession("unknown"), ShouldBeFalse)
+		_, _, ok = g.redeem(token)
+		So(ok, ShouldBeTrue) // reusable without once
+		_, _, ok = g.redeem("unknown")
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Once links can only be redeemed once", t, func() {
+		token := g.mint(0, true)
+		_, _, ok := g.redeem(token)
+		So(ok, ShouldBeTrue)
+		_, _, ok = g.redeem(token)
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Tokens and sessions expire", t, func() {
+		token := g.mint(time.Millisecond, false)
+		session, _, ok := g.redeem(token)
+		So(ok, ShouldBeTrue)
+		expired := g.mint(time.Millisecond, false)
+		time.Sleep(5 * time.Millisecond)
+		So(g.validSession(session), ShouldBeFalse)
+		_, _, ok = g.redeem(expired)
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Sweep remove expired entries never looked up", t, func() {
+		g.mint(time.Millisecond, false)
+		_, _, ok := g.redeem(g.mint(time.Millisecond, false))
+		So(ok, ShouldBeTrue)
+		kept := g.mint(0, false)
+		time.Sleep(5 * time.Millisecond)
+		g.sweep()
+		g.Lock()
+		defer g.Unlock()
+		So(g.tokens, ShouldContainKey, kept)
+		for _, st := range g.tokens {
+			So(st.expired(), ShouldBeFalse)
+		}
+		for _, expires := range g.sessions {
+			So(expires.IsZero(), ShouldBeTrue)
+		}
+	})
+
+	Convey("Visitors need a share link", t, func() {
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest("GET", "/page", nil))
+		So(rec.Code, ShouldEqual, http.StatusForbidden)
+
+		rec = httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest("GET", "/page?a=1&"+shareTokenParam+"="+g.mint(0, true), nil))
+		So(rec.Code, ShouldEqual, http.StatusFound)
+		So(rec.Header().Get("Location"), ShouldEqual, "/page?a=1")
+		cookies := rec.Result().Cookies()
+		So(cookies, ShouldHaveLength, 1)
+
+		req := httptest.NewRequest("GET", "/page", nil)
+		req.AddCookie(cookies[0])
+		rec = httptest.NewRecorder()
+		g.ServeHTTP(rec, req)
+		So(rec.Code, ShouldEqual, http.StatusOK)
+		So(rec.Body.String(), ShouldEqual, "ok")
+	})
+
+	Convey("Parse mint request", t, func() {
+		ttl, once := parseShareMint("ttl=60&once=1")
+		So(ttl, ShouldEqual, time.Minute)
+		So(once, ShouldBeTrue)
+		ttl, once = parseShareMint("")
+		So(ttl, ShouldEqual, 0)
+		So(once, ShouldBeFalse)
+	})
+}
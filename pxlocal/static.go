@@ -0,0 +1,215 @@
+package pxlocal
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var ErrOutsideRoot = errors.New("path is outside of the shared directory")
+
+// StaticOptions is used when proxy protocol is static
+type StaticOptions struct {
+	ListDirectory bool  // show file list of directory without index.html
+	SPA           bool  // serve /index.html when file not found
+	AllowUpload   bool  // accept PUT to create or replace files
+	MaxUpload     int64 // max bytes of an upload, 0 means defaultMaxUpload
+	ShowHidden    bool  // serve dotfiles like .git and .env, hidden by default
+}
+
+const defaultMaxUpload = 100 << 20
+
+// staticHandler serve a local directory directly from client
+type staticHandler struct {
+	root string
+	opts StaticOptions
+}
+
+func newStaticHandler(root string, opts StaticOptions) *staticHandler {
+	return &staticHandler{root: root, opts: opts}
+}
+
+// staticFS is the shared directory opened by os.Root, symlinks can not lead out of it
+type staticFS struct {
+	fs.FS
+	showHidden bool
+}
+
+func (f *staticFS) Open(name string) (fs.File, error) {
+	if !f.showHidden && isHiddenPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	file, err := f.FS.Open(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		// ex: a symlink to outside of root
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := file.(fs.ReadDirFile); ok && !f.showHidden {
+		if info, err := file.Stat(); err == nil && info.IsDir() {
+			return visibleDir{d}, nil
+		}
+	}
+	return file, nil
+}
+
+// visibleDir list a directory without dotfiles
+type visibleDir struct {
+	fs.ReadDirFile
+}
+
+func (d visibleDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	for {
+		entries, err := d.ReadDirFile.ReadDir(n)
+		visible := entries[:0]
+		for _, e := range entries {
+			if !strings.HasPrefix(e.Name(), ".") {
+				visible = append(visible, e)
+			}
+		}
+		if len(visible) > 0 || err != nil || n <= 0 {
+			return visible, err
+		}
+	}
+}
+
+// isHiddenPath is true when any element of slash separated name starts with a dot
+func isHiddenPath(name string) bool {
+	for _, elem := range strings.Split(name, "/") {
+		if elem != "." && elem != ".." && strings.HasPrefix(elem, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// localPath convert url path to file path, it always stays inside root
+func (h *staticHandler) localPath(urlPath string) string {
+	return filepath.Join(h.root, filepath.FromSlash(path.Clean("/"+urlPath)))
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		h.serveFile(w, r)
+	case "PUT":
+		if !h.opts.AllowUpload {
+			http.Error(w, "upload is not enabled", http.StatusMethodNotAllowed)
+			return
+		}
+		h.upload(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *staticHandler) serveFile(w http.ResponseWriter, r *http.Request) {
+	root, err := os.OpenRoot(h.root)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer root.Close()
+	fsys := &staticFS{FS: root.FS(), showHidden: h.opts.ShowHidden}
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "."
+	}
+	info, err := fs.Stat(fsys, name)
+	switch {
+	case err != nil && h.opts.SPA && path.Ext(r.URL.Path) == "":
+		// client side routes, let index.html handle it
+		http.ServeFileFS(w, r, fsys, "index.html")
+		return
+	case err == nil && info.IsDir() && !h.opts.ListDirectory:
+		if _, err := fs.Stat(fsys, path.Join(name, "index.html")); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	http.FileServerFS(fsys).ServeHTTP(w, r)
+}
+
+func (h *staticHandler) upload(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/") {
+		http.Error(w, "file name required", http.StatusBadRequest)
+		return
+	}
+	if !h.opts.ShowHidden && isHiddenPath(path.Clean("/"+r.URL.Path)) {
+		http.Error(w, "hidden files can not be uploaded", http.StatusForbidden)
+		return
+	}
+	fpath := h.localPath(r.URL.Path)
+	if err := h.checkInsideRoot(filepath.Dir(fpath)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// check again, a symlink may be created after the first check
+	if err := h.checkInsideRoot(filepath.Dir(fpath)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	maxUpload := h.opts.MaxUpload
+	if maxUpload <= 0 {
+		maxUpload = defaultMaxUpload
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUpload)
+	// write to temp file first, half uploaded file should never be served
+	tmp, err := os.CreateTemp(filepath.Dir(fpath), ".upload-*")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fpath)
+	}
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// checkInsideRoot resolve symlinks of dir, or its nearest existing parent,
+// uploads must not escape root through a symlinked directory
+func (h *staticHandler) checkInsideRoot(dir string) error {
+	root, err := filepath.EvalSymlinks(h.root)
+	if err != nil {
+		return err
+	}
+	for p := dir; ; p = filepath.Dir(p) {
+		real, err := filepath.EvalSymlinks(p)
+		if os.IsNotExist(err) && p != filepath.Dir(p) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if real != root && !strings.HasPrefix(real, root+string(filepath.Separator)) {
+			return ErrOutsideRoot
+		}
+		return nil
+	}
+}
@@ -0,0 +1,114 @@
+package pxlocal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func serveStatic(h http.Handler, method, path string, header http.Header, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestStaticHandler(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "index.html"), []byte("<h1>index</h1>"), 0644)
+	os.Mkdir(filepath.Join(root, "assets"), 0755)
+	os.WriteFile(filepath.Join(root, "assets", "app.js"), []byte("0123456789"), 0644)
+
+	Convey("Serve files with range", t, func() {
+		h := newStaticHandler(root, StaticOptions{})
+		rec := serveStatic(h, "GET", "/assets/app.js", http.Header{"Range": {"bytes=2-4"}}, "")
+		So(rec.Code, ShouldEqual, http.StatusPartialContent)
+		So(rec.Body.String(), ShouldEqual, "234")
+	})
+
+	Convey("Directory listing can be disabled", t, func() {
+		h := newStaticHandler(root, StaticOptions{})
+		So(serveStatic(h, "GET", "/assets/", nil, "").Code, ShouldEqual, http.StatusNotFound)
+		h = newStaticHandler(root, StaticOptions{ListDirectory: true})
+		rec := serveStatic(h, "GET", "/assets/", nil, "")
+		So(rec.Code, ShouldEqual, http.StatusOK)
+		So(rec.Body.String(), ShouldContainSubstring, "app.js")
+	})
+
+	Convey("SPA fallback to index.html", t, func() {
+		h := newStaticHandler(root, StaticOptions{SPA: true})
+		rec := serveStatic(h, "GET", "/users/42", nil, "")
+		So(rec.Code, ShouldEqual, http.StatusOK)
+		So(rec.Body.String(), ShouldEqual, "<h1>index</h1>")
+		So(serveStatic(h, "GET", "/assets/missing.js", nil, "").Code, ShouldEqual, http.StatusNotFound)
+	})
+
+	Convey("Upload only when enabled", t, func() {
+		h := newStaticHandler(root, StaticOptions{})
+		So(serveStatic(h, "PUT", "/new.txt", nil, "hello").Code, ShouldEqual, http.StatusMethodNotAllowed)
+
+		h = newStaticHandler(root, StaticOptions{AllowUpload: true})
+		So(serveStatic(h, "PUT", "/upload/../../new.txt", nil, "hello").Code, ShouldEqual, http.StatusCreated)
+		data, err := os.ReadFile(filepath.Join(root, "new.txt"))
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "hello")
+	})
+
+	Convey("Upload size is limited", t, func() {
+		h := newStaticHandler(root, StaticOptions{AllowUpload: true, MaxUpload: 4})
+		So(serveStatic(h, "PUT", "/big.txt", nil, "hello").Code, ShouldEqual, http.StatusRequestEntityTooLarge)
+		_, err := os.Stat(filepath.Join(root, "big.txt"))
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+
+	Convey("Upload can not escape root through symlinks", t, func() {
+		outside := t.TempDir()
+		So(os.Symlink(outside, filepath.Join(root, "link")), ShouldBeNil)
+		h := newStaticHandler(root, StaticOptions{AllowUpload: true})
+		So(serveStatic(h, "PUT", "/link/evil.txt", nil, "x").Code, ShouldEqual, http.StatusForbidden)
+		So(serveStatic(h, "PUT", "/link/sub/evil.txt", nil, "x").Code, ShouldEqual, http.StatusForbidden)
+		entries, _ := os.ReadDir(outside)
+		So(entries, ShouldBeEmpty)
+	})
+
+	Convey("Read can not escape root through symlinks", t, func() {
+		outside := t.TempDir()
+		os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644)
+		So(os.Symlink(outside, filepath.Join(root, "out")), ShouldBeNil)
+		So(os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "secret.txt")), ShouldBeNil)
+		So(os.Symlink("assets/app.js", filepath.Join(root, "app.js")), ShouldBeNil)
+		h := newStaticHandler(root, StaticOptions{ListDirectory: true})
+		for _, p := range []string{"/out/secret.txt", "/secret.txt", "/out/"} {
+			rec := serveStatic(h, "GET", p, nil, "")
+			So(rec.Code, ShouldNotEqual, http.StatusOK)
+			So(rec.Body.String(), ShouldNotContainSubstring, "secret")
+		}
+		// symlinks inside root still work
+		So(serveStatic(h, "GET", "/app.js", nil, "").Body.String(), ShouldEqual, "0123456789")
+	})
+
+	Convey("Dotfiles are hidden by default", t, func() {
+		os.WriteFile(filepath.Join(root, ".env"), []byte("TOKEN=x"), 0644)
+		os.Mkdir(filepath.Join(root, ".git"), 0755)
+		os.WriteFile(filepath.Join(root, ".git", "config"), []byte("[core]"), 0644)
+		h := newStaticHandler(root, StaticOptions{ListDirectory: true, AllowUpload: true})
+		So(serveStatic(h, "GET", "/.env", nil, "").Code, ShouldEqual, http.StatusNotFound)
+		So(serveStatic(h, "GET", "/.git/config", nil, "").Code, ShouldEqual, http.StatusNotFound)
+		So(serveStatic(h, "GET", "/assets/../.env", nil, "").Code, ShouldEqual, http.StatusNotFound)
+		So(serveStatic(h, "PUT", "/.git/hooks/pre-commit", nil, "x").Code, ShouldEqual, http.StatusForbidden)
+		rec := serveStatic(h, "GET", "/", nil, "")
+		So(rec.Body.String(), ShouldNotContainSubstring, ".env")
+		So(rec.Body.String(), ShouldNotContainSubstring, ".git")
+
+		h = newStaticHandler(root, StaticOptions{ShowHidden: true})
+		So(serveStatic(h, "GET", "/.env", nil, "").Body.String(), ShouldEqual, "TOKEN=x")
+	})
+}
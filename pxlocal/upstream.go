@@ -0,0 +1,123 @@
+package pxlocal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// localDialTimeout limit dialing local service, a filtered port should fail fast
+const localDialTimeout = 10 * time.Second
+
+// UpstreamTLS configure the tls connection to local service,
+// used when local address is https://... or tls://...
+type UpstreamTLS struct {
+	CAFile             string // custom CA bundle, default use system pool
+	CertFile           string // client certificate for mTLS
+	KeyFile            string
+	InsecureSkipVerify bool
+	ServerName         string // SNI override, default is the host of local address
+}
+
+func (o UpstreamTLS) config(host string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+	if o.ServerName != "" {
+		cfg.ServerName = o.ServerName
+	}
+	if o.CAFile != "" {
+		pool, err := LoadCertPool(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// upstream is the local service proxied to public
+type upstream struct {
+	scheme    string // http or https
+	network   string // tcp, unix or file
+	addr      string // host:port, socket path or directory
+	host      string // used in url and default Host header
+	tlsConfig *tls.Config
+}
+
+func newUpstream(opts ProxyOptions) (*upstream, error) {
+	defaultScheme := "http"
+	if opts.Proto == STATIC {
+		defaultScheme = "file"
+	}
+	u, err := ParseURL(opts.LocalAddr, URLOpts{DefaultScheme: defaultScheme})
+	if err != nil {
+		return nil, err
+	}
+	up := &upstream{scheme: "http", network: "tcp", addr: u.Host, host: u.Host}
+	switch u.Scheme {
+	case "http", "tcp", "http2":
+	case "unix":
+		up.network, up.addr, up.host = "unix", u.Path, "localhost"
+	case "file":
+		up.network, up.addr, up.host = "file", u.Path, "localhost"
+	case "https", "tls":
+		host, _, _ := net.SplitHostPort(u.Host)
+		if up.tlsConfig, err = opts.UpstreamTLS.config(host); err != nil {
+			return nil, err
+		}
+		up.scheme = "https"
+	default:
+		return nil, errors.New("unsupported local address scheme: " + u.Scheme)
+	}
+	return up, nil
+}
+
+// dialRaw connect local service without tls handshake
+func (up *upstream) dialRaw(timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout(up.network, up.addr, timeout)
+}
+
+// wrap start tls on the raw connection when required
+func (up *upstream) wrap(conn net.Conn) (net.Conn, error) {
+	if up.tlsConfig == nil {
+		return conn, nil
+	}
+	tconn := tls.Client(conn, up.tlsConfig)
+	if err := tconn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tconn, nil
+}
+
+func (up *upstream) transport(proto ProxyProtocol) *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = up.tlsConfig
+	if up.network == "unix" {
+		tr.Proxy = nil
+		tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", up.addr)
+		}
+	}
+	if proto == HTTP2 {
+		if up.tlsConfig != nil {
+			tr.Protocols = new(http.Protocols)
+			tr.Protocols.SetHTTP2(true)
+		} else {
+			tr.Protocols = h2cProtocols()
+		}
+	}
+	return tr
+}
@@ -1,11 +1,14 @@
 package pxlocal
 
 import (
+	"errors"
 	"math/rand"
 	"net"
+	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -14,10 +17,17 @@ func init() {
 }
 
 var uniqMap = make(map[string]bool)
+var uniqMapMu sync.Mutex
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyz1234567890") //ABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
+// maxUniqTries limit retries of random names, short names run out
+const maxUniqTries = 100
+
+// uniqName return a random name not in use, empty when maxUniqTries names are all taken
 func uniqName(n int) string {
-	for {
+	uniqMapMu.Lock()
+	defer uniqMapMu.Unlock()
+	for i := 0; i < maxUniqTries; i++ {
 		b := make([]rune, n)
 		for i := range b {
 			b[i] = letterRunes[rand.Intn(len(letterRunes))]
@@ -30,6 +40,14 @@ func uniqName(n int) string {
 		uniqMap[s] = true
 		return s
 	}
+	return ""
+}
+
+// releaseName make name from uniqName available again
+func releaseName(s string) {
+	uniqMapMu.Lock()
+	defer uniqMapMu.Unlock()
+	delete(uniqMap, s)
 }
 
 type URLOpts struct {
@@ -58,6 +76,9 @@ func ParseURL(s string, opts ...URLOpts) (u *url.URL, err error) {
 	}
 
 	if !regexp.MustCompile(`^(\w+)://`).MatchString(s) {
+		if opt.DefaultScheme == "file" {
+			return &url.URL{Scheme: "file", Path: s}, nil
+		}
 		if _, er := strconv.Atoi(s); er == nil { // only contain port
 			s = opt.DefaultHost + ":" + s
 		}
@@ -70,9 +91,46 @@ func ParseURL(s string, opts ...URLOpts) (u *url.URL, err error) {
 	if err != nil {
 		return
 	}
+	if u.Scheme == "unix" || u.Scheme == "file" { // unix:///path/to.sock
+		if u.Path == "" {
+			return nil, errors.New(u.Scheme + " path required")
+		}
+		return
+	}
 	// must contains port
 	if _, _, er := net.SplitHostPort(u.Host); er != nil {
-		u.Host += ":" + strconv.Itoa(opt.DefaultPort)
+		port := opt.DefaultPort
+		if u.Scheme == "https" || u.Scheme == "tls" {
+			port = 443
+		}
+		u.Host += ":" + strconv.Itoa(port)
 	}
 	return
 }
+
+// requestScheme guess the scheme the visitor used
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		return proto
+	}
+	return "http"
+}
+
+// h2cProtocols make transport speak unencrypted http/2 with prior knowledge
+func h2cProtocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetUnencryptedHTTP2(true)
+	return p
+}
+
+// ServerProtocols accept both http/1 and unencrypted http/2 (h2c) from visitors
+func ServerProtocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(true)
+	return p
+}
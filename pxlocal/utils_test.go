@@ -29,3 +29,19 @@ func TestParseURL(t *testing.T) {
 		})
 	}
 }
+
+func TestParseURLSchemes(t *testing.T) {
+	Convey("Should use 443 for https", t, func() {
+		u, err := ParseURL("https://localhost")
+		So(err, ShouldBeNil)
+		So(u.Host, ShouldEqual, "localhost:443")
+	})
+	Convey("Should parse unix socket", t, func() {
+		u, err := ParseURL("unix:///var/run/docker.sock")
+		So(err, ShouldBeNil)
+		So(u.Scheme, ShouldEqual, "unix")
+		So(u.Path, ShouldEqual, "/var/run/docker.sock")
+		_, err = ParseURL("unix://")
+		So(err, ShouldNotBeNil)
+	})
+}